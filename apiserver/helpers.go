@@ -2,71 +2,72 @@ package apiserver
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
 	"strconv"
 
 	"github.com/sakshamsharma/sarga/common/dht"
+	"github.com/sakshamsharma/sarga/common/iface"
+	"github.com/sakshamsharma/sarga/common/storage"
 )
 
 const ChunkSizeBytes = 1024 * 1024 // 1 MB
 
-func uploadFile(fileName string, data []byte, dht dht.DHT) error {
-	type dataChunk struct {
-		key             string
-		data            []byte
-		keyWithDataHash string
-	}
-
-	var chunks []dataChunk
-	var err error
+// uploadFile splits data in chunks kept in chunks, and announces self as
+// their provider unless it is the zero address. The chunks are stored in the
+// DHT too, which keeps them at the k closest nodes, so that the file outlives
+// this server. The list of chunks is stored in the DHT under the hash of
+// fileName.
+func uploadFile(ctx context.Context, fileName string, data []byte, d dht.DHT,
+	chunks storage.Storage, self iface.Address) error {
 	dataLen := len(data)
 	count := 0
 	chunkCount := 0
+	listOfChunkHashes := ""
 
 	for count < dataLen {
 		chunkCount++
 		thisChunkLen := min(ChunkSizeBytes, dataLen-count)
-		thisChunkHash := hashStr(fileName + "#" + strconv.Itoa(chunkCount))
-		dataChunk := dataChunk{
-			key:  thisChunkHash,
-			data: data[count : count+thisChunkLen],
+		chunk := data[count : count+thisChunkLen]
+		chunkHash := chunkKey(fileName, chunkCount, chunk)
+		if err := chunks.Store(chunkHash, chunk); err != nil {
+			return err
 		}
-		dataChunk.keyWithDataHash = hashStr(dataChunk.key + base64.StdEncoding.EncodeToString(dataChunk.data))
-		chunks = append(chunks, dataChunk)
-		count += thisChunkLen
-	}
-
-	if chunkCount == 1 {
-		// Store the chunk directly, and prepend a 0 byte in the beginning to mark
-		// that the complete file is in this data piece.
-		err = dht.StoreValue(hashStr(fileName), append([]byte{0}, chunks[0].data...))
-	} else {
-		listOfChunkHashes := ""
-		for i, chunk := range chunks {
-			if i != 0 {
-				listOfChunkHashes += "#"
+		if self != (iface.Address{}) {
+			if err := d.AddProvider(ctx, chunkHash, self, 0); err != nil {
+				return err
 			}
-			listOfChunkHashes += chunk.keyWithDataHash
 		}
-		err = dht.StoreValue(hashStr(fileName), append([]byte{1}, []byte(listOfChunkHashes)...))
+		if err := d.StoreValue(ctx, chunkHash, chunk, 0); err != nil {
+			return err
+		}
 
-		for _, chunk := range chunks {
-			if err != nil {
-				return err
-			}
-			dataToStore := append([]byte{0}, []byte(chunk.data)...)
-			err = dht.StoreValue(chunk.keyWithDataHash, dataToStore)
+		if chunkCount != 1 {
+			listOfChunkHashes += "#"
 		}
+		listOfChunkHashes += chunkHash
+		count += thisChunkLen
 	}
-	return err
+
+	return d.StoreValue(ctx, hashStr(fileName), append([]byte{1}, []byte(listOfChunkHashes)...), 0)
 }
 
-func downloadFile(fileName string, dht dht.DHT) ([]byte, error) {
-	data, err := dht.FindValue(hashStr(fileName))
+// downloadFile fetches the list of chunks of fileName from the DHT, and then
+// every chunk from chunks or from one of its providers.
+func downloadFile(ctx context.Context, fileName string, d dht.DHT,
+	chunks storage.Storage, net iface.Net) ([]byte, error) {
+	data, err := d.FindValue(ctx, hashStr(fileName))
 	if err != nil {
 		return nil, err
 	}
@@ -81,20 +82,124 @@ func downloadFile(fileName string, dht dht.DHT) ([]byte, error) {
 	}
 
 	result := []byte{}
-	for _, chunkHash := range bytes.Split(data[1:], []byte("#")) {
-		chunk, err := dht.FindValue(string(chunkHash))
+	if len(data) == 1 {
+		// The file is empty.
+		return result, nil
+	}
+	for i, chunkHash := range bytes.Split(data[1:], []byte("#")) {
+		chunk, err := fetchChunk(ctx, fileName, i+1, string(chunkHash), d, chunks, net)
 		if err != nil {
 			return nil, err
 		}
-		if len(chunk) == 0 {
-			return nil, fmt.Errorf("empty data returned by DHT for key %q", string(chunkHash))
-		}
-		result = append(result, chunk[1:]...)
+		result = append(result, chunk...)
 	}
 
 	return result, nil
 }
 
+// fetchChunk returns the chunk number index of fileName, stored under
+// chunkHash. It is read from chunks if present, and otherwise downloaded from
+// the first of its providers which returns the data matching chunkHash, or
+// from the DHT if none does.
+func fetchChunk(ctx context.Context, fileName string, index int, chunkHash string, d dht.DHT,
+	chunks storage.Storage, net iface.Net) ([]byte, error) {
+	if chunk, err := chunks.Fetch(chunkHash); err == nil {
+		return chunk, nil
+	}
+
+	providers, err := d.FindProviders(ctx, chunkHash)
+	if err != nil {
+		log.Printf("Could not find providers of chunk %q: %v", chunkHash, err)
+	}
+	for _, addr := range providers {
+		chunk, err := net.Get(ctx, addr, "sarga/chunks/"+chunkHash)
+		if err == nil && chunkKey(fileName, index, chunk) != chunkHash {
+			err = fmt.Errorf("invalid data returned for chunk %q", chunkHash)
+		}
+		if err != nil {
+			log.Printf("Could not fetch chunk %q from %v: %v", chunkHash, addr, err)
+			continue
+		}
+		return chunk, nil
+	}
+
+	chunk, err := d.FindValue(ctx, chunkHash)
+	if err == nil && chunkKey(fileName, index, chunk) != chunkHash {
+		err = fmt.Errorf("invalid data returned for chunk %q", chunkHash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch chunk %q from any of its %d providers nor from the DHT: %v",
+			chunkHash, len(providers), err)
+	}
+	return chunk, nil
+}
+
+// chunkKey returns the key of the chunk number index of fileName, which is
+// derived from its data so that downloaded chunks can be checked.
+func chunkKey(fileName string, index int, chunk []byte) string {
+	return hashStr(hashStr(fileName+"#"+strconv.Itoa(index)) + base64.StdEncoding.EncodeToString(chunk))
+}
+
+// publishRecord publishes value as the next version of the mutable record of
+// publisher with the given salt, and returns the key of the record. The record
+// starts at version 1 only if no version of it is found, rather than if none
+// could be fetched, since the nodes would refuse it over the current version.
+func publishRecord(ctx context.Context, publisher ed25519.PrivateKey, salt string, value []byte, d dht.DHT) (string, error) {
+	key := dht.MutableKey(publisher.Public().(ed25519.PublicKey), []byte(salt))
+	seq := int64(1)
+	old, err := d.FindMutable(ctx, key)
+	switch {
+	case err == nil:
+		seq = old.Seq + 1
+	case !errors.Is(err, dht.ErrNotFound):
+		return "", fmt.Errorf("could not fetch the current version of %q: %v", salt, err)
+	}
+
+	rec := dht.NewMutableRecord(publisher, []byte(salt), seq, value)
+	if err := d.StoreMutable(ctx, rec, 0); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// resolveRecord returns the value of the mutable record stored under key.
+func resolveRecord(ctx context.Context, key string, d dht.DHT) ([]byte, error) {
+	rec, err := d.FindMutable(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return rec.Value, nil
+}
+
+// loadPublisherKey reads the key used to publish mutable records from path.
+// If the file does not exist, a new key is generated and written to it.
+func loadPublisherKey(path string) (ed25519.PrivateKey, error) {
+	seed, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf(
+				"invalid publisher key in %q, expected length %d, got: %d",
+				path, ed25519.SeedSize, len(seed))
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, key.Seed(), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
 func hashStr(s string) string {
 	h := sha1.New()
 	io.WriteString(h, s)
@@ -1,12 +1,16 @@
 package apiserver
 
 import (
+	"crypto/ed25519"
+	crand "crypto/rand"
 	"fmt"
 	"math/rand"
+	"path/filepath"
 	"time"
 
 	arg "github.com/alexflint/go-arg"
 	"github.com/sakshamsharma/sarga/common/iface"
+	"github.com/sakshamsharma/sarga/common/storage"
 	"github.com/sakshamsharma/sarga/impl/httpnet"
 	"github.com/sakshamsharma/sarga/impl/sdht"
 	"github.com/sakshamsharma/sarga/impl/slog"
@@ -19,6 +23,28 @@ type ServerArgs struct {
 	RandomDHTCount int
 
 	DHTLogLevel string
+	// DataDir is where the node keeps its state across restarts, including
+	// the key it publishes mutable records with and the chunks it provides.
+	// State is not persisted if empty.
+	DataDir string
+	// ChunksAddr is the address, such as 0.0.0.0:7000, on which the chunks of
+	// the files uploaded through this server are served to other servers,
+	// which then download them from it directly. They are only available
+	// through the DHT if empty.
+	ChunksAddr string
+	// DHTDifficulty is the crypto puzzle difficulty node IDs must meet. It
+	// must be the same on every node of the network.
+	DHTDifficulty int
+	// DHTBinaryCodec makes the DHT send RPCs in the compact binary encoding
+	// rather than JSON.
+	DHTBinaryCodec bool
+	// DiscoveryGroup is the multicast group and port, such as
+	// 239.255.77.77:7946, on which the DHT discovers peers on the local
+	// network. Discovery is disabled if empty.
+	DiscoveryGroup string
+	// DiscoveryInterface is the network interface used for discovery, the
+	// system default if empty.
+	DiscoveryInterface string
 }
 
 func Init() error {
@@ -33,6 +59,14 @@ func Init() error {
 		args.IP = "127.0.0.1"
 	}
 
+	var chunksAddr iface.Address
+	if args.ChunksAddr != "" {
+		var err error
+		if chunksAddr, err = iface.ParseAddress(args.ChunksAddr); err != nil {
+			return err
+		}
+	}
+
 	for _, seed := range args.Seeds {
 		fmt.Println(seed)
 	}
@@ -42,11 +76,29 @@ func Init() error {
 		return err
 	}
 
+	var logLevel slog.Level
 	if args.DHTLogLevel != "" {
-		sdht.SetLog(slog.GetLevelFromString(args.DHTLogLevel))
+		logLevel = slog.GetLevelFromString(args.DHTLogLevel)
 	}
 
-	dhtInst := &sdht.SDHT{}
+	codec := sdht.JSONCodec
+	if args.DHTBinaryCodec {
+		codec = sdht.BinaryCodec
+	}
+
+	dhtInst := &sdht.SDHT{LogLevel: logLevel, Difficulty: args.DHTDifficulty, Codec: codec}
+	if args.DiscoveryGroup != "" {
+		group, err := iface.ParseAddress(args.DiscoveryGroup)
+		if err != nil {
+			return err
+		}
+		dhtInst.DiscoveryGroup = group
+		dhtInst.DiscoveryInterface = args.DiscoveryInterface
+	}
+	if args.DataDir != "" {
+		dhtInst.IdentityFile = filepath.Join(args.DataDir, "identity.json")
+		dhtInst.RoutingTableFile = filepath.Join(args.DataDir, "routing.json")
+	}
 	if err = dhtInst.Init(iface.Address{IP: "0.0.0.0", Port: 8080},
 		seeds, &httpnet.HTTPNet{}); err != nil {
 		return err
@@ -58,7 +110,7 @@ func Init() error {
 		ports := []int{8080}
 
 		for i := 1; i <= args.RandomDHTCount; i++ {
-			nodeDHT := &sdht.SDHT{}
+			nodeDHT := &sdht.SDHT{LogLevel: logLevel, Difficulty: args.DHTDifficulty, Codec: codec}
 			addr := iface.Address{IP: "0.0.0.0", Port: rand.Intn(3000) + 4000}
 			ports = append(ports, addr.Port)
 			nodeDHT.Init(addr,
@@ -68,7 +120,24 @@ func Init() error {
 		time.Sleep(2 * time.Second)
 	}
 
-	StartAPIServer(args.CommonArgs, dhtInst)
+	var publisher ed25519.PrivateKey
+	if args.DataDir != "" {
+		publisher, err = loadPublisherKey(filepath.Join(args.DataDir, "publisher.key"))
+	} else {
+		_, publisher, err = ed25519.GenerateKey(crand.Reader)
+	}
+	if err != nil {
+		return fmt.Errorf("error while loading publisher key: %v", err)
+	}
+
+	// Uploaded chunks are kept on disk, so that this node keeps providing them
+	// across restarts.
+	var chunks storage.Storage = &storage.MemStorage{}
+	if args.DataDir != "" {
+		chunks = &storage.DiskStorage{Dir: filepath.Join(args.DataDir, "chunks")}
+	}
+
+	StartAPIServer(args.CommonArgs, chunksAddr, dhtInst, publisher, chunks)
 
 	return nil
 }
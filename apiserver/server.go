@@ -1,33 +1,55 @@
 package apiserver
 
 import (
+	"crypto/ed25519"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/elazarl/goproxy"
 
 	"github.com/sakshamsharma/sarga/common/dht"
 	"github.com/sakshamsharma/sarga/common/iface"
+	"github.com/sakshamsharma/sarga/common/storage"
+	"github.com/sakshamsharma/sarga/impl/httpnet"
 )
 
 type handleFuncType func(rw http.ResponseWriter, req *http.Request)
 
+// StartAPIServer serves the API of this node, keeping the chunks of the files
+// uploaded through it in chunks. Unless chunksAddr is the zero address, the
+// chunks are served to other servers on a separate listener at chunksAddr,
+// and this server is announced as their provider.
 // TODO(sakshams): Should have a shutdown channel for integration tests.
-func StartAPIServer(args iface.CommonArgs, dht dht.DHT) {
-	h := &proxyHandler{dht}
+func StartAPIServer(args iface.CommonArgs, chunksAddr iface.Address, dht dht.DHT, publisher ed25519.PrivateKey, chunks storage.Storage) {
+	chunks.Init()
+	addr := iface.GetAddress(args.IP, args.Port)
+	h := &proxyHandler{dht, publisher, chunks, &httpnet.HTTPNet{}, chunksAddr}
 	fs := http.FileServer(http.Dir("static"))
 
 	http.HandleFunc("/sarga/upload/", prefixHandler("/sarga/upload", h.uploadHandler))
 	http.HandleFunc("/sarga/files/", prefixHandler("/sarga/files", h.filesHandler))
 	http.HandleFunc("/sarga/info/", prefixHandler("/sarga/info", h.apiHandler))
+	http.HandleFunc("/sarga/records/", prefixHandler("/sarga/records", h.recordsHandler))
 	http.Handle("/sarga/", http.StripPrefix("/sarga", fs))
 	http.Handle("/", goproxy.NewProxyHttpServer())
 
-	addr := iface.GetAddress(args.IP, args.Port).String()
+	if chunksAddr != (iface.Address{}) {
+		go func() {
+			log.Println("Serving chunks on", chunksAddr)
+			if err := http.ListenAndServe(chunksAddr.String(), h.chunksServer()); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
 	log.Println("Listening on", addr)
-	err := http.ListenAndServe(addr, nil)
+	err := http.ListenAndServe(addr.String(), nil)
 	if err != nil {
 		log.Println(err)
 	}
@@ -42,8 +64,63 @@ func prefixHandler(prefix string, handler handleFuncType) handleFuncType {
 	}
 }
 
+// chunksServer returns the handler of the listener chunks are served on. It
+// serves nothing else, so that the listener can be reachable by other servers
+// while the API and the proxy stay local.
+func (h *proxyHandler) chunksServer() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sarga/chunks/", prefixHandler("/sarga/chunks", h.chunksHandler))
+	return mux
+}
+
+// reachable is implemented by DHTs which learn the IP other nodes reach them
+// at, such as sdht.SDHT.
+type reachable interface {
+	ExternalIP() string
+}
+
 type proxyHandler struct {
 	dht dht.DHT
+	// publisher is the key used to sign the mutable records published
+	// through this server.
+	publisher ed25519.PrivateKey
+	// chunks holds the chunks of the files uploaded through this server,
+	// which it serves to other servers as their provider.
+	chunks storage.Storage
+	// net is used to download chunks from their providers.
+	net iface.Net
+	// addr is the address this server serves chunks at, or the zero address
+	// if it does not.
+	addr iface.Address
+}
+
+// providerAddr returns the address this server is announced as a provider at,
+// or the zero address if it does not serve chunks. It is the address chunks
+// are served at if that is a single host, and else the IP the DHT is reachable
+// at, or the first IP of this machine which is not loopback.
+func (h *proxyHandler) providerAddr() (iface.Address, error) {
+	addr := h.addr
+	if addr == (iface.Address{}) {
+		return addr, nil
+	}
+	if ip := net.ParseIP(addr.IP); addr.IP != "" && (ip == nil || !ip.IsUnspecified()) {
+		return addr, nil
+	}
+	if r, ok := h.dht.(reachable); ok && r.ExternalIP() != "" {
+		addr.IP = r.ExternalIP()
+		return addr, nil
+	}
+	ips, err := net.InterfaceAddrs()
+	if err != nil {
+		return iface.Address{}, fmt.Errorf("error while listing the addresses of this machine: %v", err)
+	}
+	for _, ip := range ips {
+		if ipNet, ok := ip.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			addr.IP = ipNet.IP.String()
+			return addr, nil
+		}
+	}
+	return iface.Address{}, fmt.Errorf("no address of this machine is reachable by other servers")
 }
 
 func (h *proxyHandler) uploadHandler(rw http.ResponseWriter, req *http.Request) {
@@ -55,7 +132,10 @@ func (h *proxyHandler) uploadHandler(rw http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	err = uploadFile(req.URL.Path, data, h.dht)
+	self, err := h.providerAddr()
+	if err == nil {
+		err = uploadFile(req.Context(), req.URL.Path, data, h.dht, h.chunks, self)
+	}
 	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte(err.Error()))
@@ -69,7 +149,7 @@ func (h *proxyHandler) filesHandler(rw http.ResponseWriter, req *http.Request) {
 	// Download file.
 	if req.Method == "GET" {
 		// Fetch file.
-		data, err := downloadFile(req.URL.Path, h.dht)
+		data, err := downloadFile(req.Context(), req.URL.Path, h.dht, h.chunks, h.net)
 		if err != nil {
 			rw.WriteHeader(http.StatusNotFound)
 			rw.Write([]byte(err.Error()))
@@ -90,6 +170,75 @@ func (h *proxyHandler) filesHandler(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// recordsHandler publishes the body of a POST request as the next version of
+// the record of this server named by the path, and returns the key of the
+// record. A GET request with a record key as path returns the value of the
+// record.
+func (h *proxyHandler) recordsHandler(rw http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	switch req.Method {
+	case "GET":
+		data, err := resolveRecord(req.Context(), name, h.dht)
+		if err != nil {
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte(err.Error()))
+			log.Println(err)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(data)
+
+	case "POST":
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("Error while reading body of request: " + err.Error()))
+			return
+		}
+		key, err := publishRecord(req.Context(), h.publisher, name, data, h.dht)
+		if errors.Is(err, dht.ErrConflict) {
+			rw.WriteHeader(http.StatusConflict)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte(key))
+
+	default:
+		rw.WriteHeader(http.StatusBadRequest)
+		_, err := rw.Write([]byte("Unsupported method. Allowed methods: GET, POST"))
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// chunksHandler returns the chunk stored under the key given as path, for
+// servers downloading it from this provider.
+func (h *proxyHandler) chunksHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		rw.WriteHeader(http.StatusBadRequest)
+		_, err := rw.Write([]byte("Unsupported method. Allowed methods: GET"))
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	data, err := h.chunks.Fetch(strings.TrimPrefix(req.URL.Path, "/"))
+	if err != nil {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(data)
+}
+
 func (h *proxyHandler) apiHandler(rw http.ResponseWriter, req *http.Request) {
 	if req.Method != "GET" {
 		rw.WriteHeader(http.StatusBadRequest)
@@ -99,7 +248,7 @@ func (h *proxyHandler) apiHandler(rw http.ResponseWriter, req *http.Request) {
 		}
 		return
 	}
-	v := h.dht.Respond("info", nil)
+	v := h.dht.Respond(req.Context(), "info", nil)
 	rw.WriteHeader(http.StatusOK)
 	rw.Write(v)
 }
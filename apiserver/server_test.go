@@ -2,18 +2,25 @@ package apiserver
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/sakshamsharma/sarga/common/dht"
 	"github.com/sakshamsharma/sarga/common/iface"
+	"github.com/sakshamsharma/sarga/common/storage"
 	"github.com/sakshamsharma/sarga/impl/httpnet"
+	"github.com/sakshamsharma/sarga/impl/sdht"
+	"github.com/sakshamsharma/sarga/impl/testnet"
 )
 
 func init() {
@@ -27,10 +34,11 @@ func TestUploadDownloadE2E(t *testing.T) {
 	port := rand.Intn(5000) + 2000
 
 	// TODO(sakshams): This goroutine does not terminate cleanly yet.
+	_, publisher, _ := ed25519.GenerateKey(nil)
 	go StartAPIServer(iface.CommonArgs{
 		Port: port,
 		IP:   "127.0.0.1",
-	}, dht)
+	}, iface.Address{}, dht, publisher, &storage.MemStorage{})
 
 	time.Sleep(2)
 
@@ -68,17 +76,19 @@ func TestUploadDownloadE2E(t *testing.T) {
 func TestUploadDownload(t *testing.T) {
 	dht := &dht.FakeDHT{}
 	dht.Init(iface.Address{}, []iface.Address{}, &httpnet.HTTPNet{})
+	chunks := &storage.MemStorage{}
+	chunks.Init()
 
 	testLen := rand.Intn(1024 * 20)
 	buf := make([]byte, testLen)
 	rand.Read(buf)
 
-	err := uploadFile("coolfile", buf, dht)
+	err := uploadFile(context.Background(), "coolfile", buf, dht, chunks, iface.Address{})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	data, err := downloadFile("coolfile", dht)
+	data, err := downloadFile(context.Background(), "coolfile", dht, chunks, &httpnet.HTTPNet{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -92,18 +102,20 @@ func TestUploadDownload(t *testing.T) {
 func TestChunking(t *testing.T) {
 	dht := &dht.FakeDHT{}
 	dht.Init(iface.Address{}, []iface.Address{}, &httpnet.HTTPNet{})
+	chunks := &storage.MemStorage{}
+	chunks.Init()
 
 	testLen := 5*ChunkSizeBytes + rand.Intn(1024)
 
 	buf := make([]byte, testLen)
 	rand.Read(buf)
 
-	err := uploadFile("coolfile", buf, dht)
+	err := uploadFile(context.Background(), "coolfile", buf, dht, chunks, iface.Address{})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	data, err := downloadFile("coolfile", dht)
+	data, err := downloadFile(context.Background(), "coolfile", dht, chunks, &httpnet.HTTPNet{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -114,6 +126,160 @@ func TestChunking(t *testing.T) {
 	}
 }
 
+func TestDownloadFromProvider(t *testing.T) {
+	dht := &dht.FakeDHT{}
+	dht.Init(iface.Address{}, []iface.Address{}, &httpnet.HTTPNet{})
+	uploaded := &storage.MemStorage{}
+	uploaded.Init()
+	provider := httptest.NewServer(http.HandlerFunc(
+		prefixHandler("/sarga/chunks", (&proxyHandler{chunks: uploaded}).chunksHandler)))
+	defer provider.Close()
+	providerAddr, _ := iface.ParseAddress(provider.Listener.Addr().String())
+
+	// The liar is announced first as a provider of the first chunk, and
+	// returns garbage for it.
+	liar := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("garbage"))
+	}))
+	defer liar.Close()
+	liarAddr, _ := iface.ParseAddress(liar.Listener.Addr().String())
+
+	buf := make([]byte, 2*ChunkSizeBytes+rand.Intn(1024))
+	rand.Read(buf)
+	dht.AddProvider(context.Background(), chunkKey("coolfile", 1, buf[:ChunkSizeBytes]), liarAddr, 0)
+
+	err := uploadFile(context.Background(), "coolfile", buf, dht, uploaded, providerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	downloaded := &storage.MemStorage{}
+	downloaded.Init()
+	data, err := downloadFile(context.Background(), "coolfile", dht, downloaded, &httpnet.HTTPNet{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = compareBufs(data, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a provider, chunks are downloaded from the DHT.
+	provider.Close()
+	downloaded = &storage.MemStorage{}
+	downloaded.Init()
+	data, err = downloadFile(context.Background(), "coolfile", dht, downloaded, &httpnet.HTTPNet{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = compareBufs(data, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownloadWithoutUploader(t *testing.T) {
+	network := testnet.InitTestNet()
+	dhts := []*sdht.SDHT{}
+	for i := 0; i < 10; i++ {
+		d := &sdht.SDHT{K: 3}
+		addr := iface.Address{IP: strconv.Itoa(i), Port: 0}
+		network.Add(addr, d)
+		seeds := []iface.Address{}
+		if i != 0 {
+			seeds = append(seeds, iface.Address{IP: strconv.Itoa(rand.Intn(i)), Port: 0})
+		}
+		if err := d.Init(addr, seeds, network); err != nil {
+			t.Fatal(err)
+		}
+		dhts = append(dhts, d)
+	}
+	defer func() {
+		for _, d := range dhts {
+			d.Shutdown()
+		}
+	}()
+
+	uploaded := &storage.MemStorage{}
+	uploaded.Init()
+	uploader := httptest.NewServer(http.HandlerFunc(
+		prefixHandler("/sarga/chunks", (&proxyHandler{chunks: uploaded}).chunksHandler)))
+	uploaderAddr, _ := iface.ParseAddress(uploader.Listener.Addr().String())
+
+	buf := make([]byte, 2*ChunkSizeBytes+rand.Intn(1024))
+	rand.Read(buf)
+	if err := uploadFile(context.Background(), "coolfile", buf, dhts[0], uploaded, uploaderAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	// The uploading server crashes along with its DHT node, without handing
+	// anything off.
+	uploader.Close()
+	network.Remove(iface.Address{IP: "0", Port: 0})
+
+	downloaded := &storage.MemStorage{}
+	downloaded.Init()
+	data, err := downloadFile(context.Background(), "coolfile", dhts[len(dhts)-1], downloaded, &httpnet.HTTPNet{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = compareBufs(data, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublishResolve(t *testing.T) {
+	dht := &dht.FakeDHT{}
+	dht.Init(iface.Address{}, []iface.Address{}, &httpnet.HTTPNet{})
+	_, publisher, _ := ed25519.GenerateKey(nil)
+
+	key, err := publishRecord(context.Background(), publisher, "homepage", []byte("v1"), dht)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatedKey, err := publishRecord(context.Background(), publisher, "homepage", []byte("v2"), dht)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updatedKey != key {
+		t.Fatalf("expected the record to keep key %q, got %q", key, updatedKey)
+	}
+
+	data, err := resolveRecord(context.Background(), key, dht)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "v2" {
+		t.Fatalf("expected the latest version %q, got %q", "v2", data)
+	}
+
+	// Another publisher gets a different key for the same name.
+	_, other, _ := ed25519.GenerateKey(nil)
+	otherKey, err := publishRecord(context.Background(), other, "homepage", []byte("other"), dht)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherKey == key {
+		t.Fatalf("expected publishers to not share keys")
+	}
+
+	// A record whose current version can not be fetched is not published
+	// again as version 1.
+	if _, err := publishRecord(context.Background(), publisher, "homepage", []byte("v3"), unreachableDHT{dht}); err == nil {
+		t.Fatalf("expected an error publishing a record whose version could not be fetched")
+	}
+	if data, _ := resolveRecord(context.Background(), key, dht); string(data) != "v2" {
+		t.Fatalf("expected version %q to be kept, got %q", "v2", data)
+	}
+}
+
+// unreachableDHT fails to fetch mutable records, as if no node answered.
+type unreachableDHT struct {
+	*dht.FakeDHT
+}
+
+func (unreachableDHT) FindMutable(context.Context, string) (dht.MutableRecord, error) {
+	return dht.MutableRecord{}, errors.New("no node answered")
+}
+
 // compareBufs compares the expected buffer buf with the received buffer data.
 func compareBufs(data, buf []byte) error {
 	if len(data) != len(buf) {
@@ -127,3 +293,52 @@ func compareBufs(data, buf []byte) error {
 	}
 	return nil
 }
+
+// externalDHT is a FakeDHT which peers reach at ip.
+type externalDHT struct {
+	*dht.FakeDHT
+	ip string
+}
+
+func (d externalDHT) ExternalIP() string {
+	return d.ip
+}
+
+func TestProviderAddr(t *testing.T) {
+	h := &proxyHandler{dht: externalDHT{&dht.FakeDHT{}, "192.0.2.7"}}
+	if addr, err := h.providerAddr(); err != nil || addr != (iface.Address{}) {
+		t.Fatalf("expected to not be announced without serving chunks, got %v, %v", addr, err)
+	}
+	h.addr = iface.Address{Port: 80}
+	if addr, err := h.providerAddr(); err != nil || addr != (iface.Address{IP: "192.0.2.7", Port: 80}) {
+		t.Fatalf("expected to be announced at the external IP of the DHT, got %v, %v", addr, err)
+	}
+	h.addr.IP = "10.0.0.1"
+	if addr, err := h.providerAddr(); err != nil || addr != h.addr {
+		t.Fatalf("expected to be announced at the address listened on, got %v, %v", addr, err)
+	}
+}
+
+func TestChunksServer(t *testing.T) {
+	chunks := &storage.MemStorage{}
+	chunks.Init()
+	chunks.Store("key", []byte("chunk"))
+	handler := (&proxyHandler{chunks: chunks}).chunksServer()
+	for _, c := range []struct {
+		method, target string
+		code           int
+	}{
+		{"GET", "/sarga/chunks/key", http.StatusOK},
+		{"GET", "/sarga/chunks/missing", http.StatusNotFound},
+		{"POST", "/sarga/upload/file", http.StatusNotFound},
+		{"GET", "/sarga/info/", http.StatusNotFound},
+		{"GET", "http://example.com/", http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(c.method, c.target, nil)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		if rw.Code != c.code {
+			t.Fatalf("expected status %d for %s %s, got %d", c.code, c.method, c.target, rw.Code)
+		}
+	}
+}
@@ -1,49 +1,124 @@
 package dht
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/sakshamsharma/sarga/common/iface"
 )
 
+// Errors returned by implementations of DHT. Use errors.Is to check for them.
+var (
+	// ErrNotFound is returned when nothing is stored under a key.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a version of a mutable record is not
+	// stored because a newer or different one with the same sequence number
+	// already is.
+	ErrConflict = errors.New("conflict")
+)
+
 // DHT is a common interface to be satisfied by
 // all implementations to be used with sarga.
+//
+// Methods taking a context give up with its error once it is done, including
+// the RPCs they sent to other nodes.
 type DHT interface {
 	Init(addr iface.Address, seeds []iface.Address, net iface.Net) error
-	FindValue(key string) ([]byte, error)
-	StoreValue(key string, data []byte) error
+	FindValue(ctx context.Context, key string) ([]byte, error)
+	// StoreValue stores data under key. The value expires ttl after it was
+	// last published; a non-positive ttl selects the implementation default.
+	StoreValue(ctx context.Context, key string, data []byte, ttl time.Duration) error
+	// StoreMutable stores a version of a mutable record under rec.Key(). It
+	// only replaces versions with a lower sequence number, and returns an
+	// error wrapping ErrConflict if the version was not stored because of
+	// one. The version expires like values stored with StoreValue.
+	StoreMutable(ctx context.Context, rec MutableRecord, ttl time.Duration) error
+	// FindMutable returns the version of the mutable record stored under key,
+	// after checking that it is signed by its publisher. The error wraps
+	// ErrNotFound if no version is stored.
+	FindMutable(ctx context.Context, key string) (MutableRecord, error)
+	// AddProvider announces that the node at addr holds the data of key, so
+	// that the data itself need not be stored in the DHT. The announcement
+	// expires ttl after it was last made; a non-positive ttl selects the
+	// implementation default.
+	AddProvider(ctx context.Context, key string, addr iface.Address, ttl time.Duration) error
+	// FindProviders returns the addresses announced as holding the data of
+	// key.
+	FindProviders(ctx context.Context, key string) ([]iface.Address, error)
 	Shutdown()
 
 	// Respond consumes a path and data, and returns the serialized response.
 	// Helpful for unit tests.
-	Respond(string, []byte) []byte
+	Respond(context.Context, string, []byte) []byte
 }
 
 type FakeDHT struct {
-	data map[string][]byte
+	data      map[string][]byte
+	providers map[string][]iface.Address
 }
 
 var _ DHT = &FakeDHT{}
 
 func (f *FakeDHT) Init(addr iface.Address, seeds []iface.Address, net iface.Net) error {
 	f.data = map[string][]byte{}
+	f.providers = map[string][]iface.Address{}
 	return nil
 }
 
-func (f *FakeDHT) FindValue(key string) ([]byte, error) {
+func (f *FakeDHT) FindValue(_ context.Context, key string) ([]byte, error) {
 	if val, ok := f.data[key]; ok {
 		return val, nil
 	}
-	return nil, fmt.Errorf("Key %q not found in FakeDHT", key)
+	return nil, fmt.Errorf("Key %q not found in FakeDHT: %w", key, ErrNotFound)
 }
 
-func (f *FakeDHT) StoreValue(key string, data []byte) error {
+func (f *FakeDHT) StoreValue(_ context.Context, key string, data []byte, ttl time.Duration) error {
 	f.data[key] = data
 	return nil
 }
 
+func (f *FakeDHT) StoreMutable(ctx context.Context, rec MutableRecord, ttl time.Duration) error {
+	if err := rec.Verify(); err != nil {
+		return err
+	}
+	if old, err := f.FindMutable(ctx, rec.Key()); err == nil &&
+		(old.Seq > rec.Seq || old.Seq == rec.Seq && !bytes.Equal(old.Value, rec.Value)) {
+		return fmt.Errorf("%w: version %d of mutable record %q is stored", ErrConflict, old.Seq, rec.Key())
+	}
+	f.data[rec.Key()] = rec.Marshal()
+	return nil
+}
+
+func (f *FakeDHT) FindMutable(ctx context.Context, key string) (MutableRecord, error) {
+	data, err := f.FindValue(ctx, key)
+	if err != nil {
+		return MutableRecord{}, err
+	}
+	return UnmarshalMutableRecord(key, data)
+}
+
+func (f *FakeDHT) AddProvider(_ context.Context, key string, addr iface.Address, ttl time.Duration) error {
+	for _, a := range f.providers[key] {
+		if a == addr {
+			return nil
+		}
+	}
+	f.providers[key] = append(f.providers[key], addr)
+	return nil
+}
+
+func (f *FakeDHT) FindProviders(_ context.Context, key string) ([]iface.Address, error) {
+	if addrs, ok := f.providers[key]; ok {
+		return addrs, nil
+	}
+	return nil, fmt.Errorf("No providers of key %q in FakeDHT", key)
+}
+
 func (f *FakeDHT) Shutdown() {}
 
-func (f *FakeDHT) Respond(string, []byte) []byte {
+func (f *FakeDHT) Respond(context.Context, string, []byte) []byte {
 	return nil
 }
@@ -0,0 +1,96 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// MutableRecord is a value which its publisher can update, similar to
+// BitTorrent BEP 44. It is stored under a key derived from the public key of
+// its publisher and a salt, so that only the holder of the private key can
+// publish versions of it, and one publisher can have many records.
+type MutableRecord struct {
+	PublicKey ed25519.PublicKey
+	Salt      []byte
+	// Seq orders the versions of the record. Storing nodes only replace a
+	// version with one of a higher sequence number.
+	Seq       int64
+	Value     []byte
+	Signature []byte
+}
+
+// MutableKey returns the key under which the records published with key and
+// salt are stored.
+func MutableKey(key ed25519.PublicKey, salt []byte) string {
+	h := sha1.New()
+	h.Write(key)
+	h.Write(salt)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// NewMutableRecord returns version seq of the record published with key and
+// salt, holding value.
+func NewMutableRecord(key ed25519.PrivateKey, salt []byte, seq int64, value []byte) MutableRecord {
+	rec := MutableRecord{
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Salt:      salt,
+		Seq:       seq,
+		Value:     value,
+	}
+	rec.Signature = ed25519.Sign(key, rec.signedPayload())
+	return rec
+}
+
+// Key returns the key under which the record is stored.
+func (r MutableRecord) Key() string {
+	return MutableKey(r.PublicKey, r.Salt)
+}
+
+// Verify checks that the record is signed by its publisher.
+func (r MutableRecord) Verify() error {
+	if len(r.PublicKey) != ed25519.PublicKeySize {
+		return errors.New("invalid public key in mutable record")
+	}
+	if !ed25519.Verify(r.PublicKey, r.signedPayload(), r.Signature) {
+		return errors.New("invalid signature in mutable record")
+	}
+	return nil
+}
+
+// signedPayload returns what the publisher signs, which covers everything but
+// the public key, from which the key of the record is derived anyway.
+func (r MutableRecord) signedPayload() []byte {
+	bytes, _ := json.Marshal(struct {
+		Salt  []byte
+		Seq   int64
+		Value []byte
+	}{r.Salt, r.Seq, r.Value})
+	return bytes
+}
+
+// Marshal returns the serialized record, as stored in the DHT.
+func (r MutableRecord) Marshal() []byte {
+	bytes, _ := json.Marshal(r)
+	return bytes
+}
+
+// UnmarshalMutableRecord parses a record stored under key, and verifies that
+// it is signed by its publisher and belongs under key.
+func UnmarshalMutableRecord(key string, data []byte) (MutableRecord, error) {
+	rec := MutableRecord{}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return MutableRecord{}, fmt.Errorf("invalid mutable record: %v", err)
+	}
+	if err := rec.Verify(); err != nil {
+		return MutableRecord{}, err
+	}
+	if rec.Key() != key {
+		return MutableRecord{}, fmt.Errorf(
+			"mutable record belongs under key %s, not %s", rec.Key(), key)
+	}
+	return rec, nil
+}
@@ -0,0 +1,93 @@
+package iface
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock tells the time, and runs functions once some time has passed. It lets
+// simulations run nodes on a virtual clock.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once d has passed. stop keeps f
+	// from being called, and returns false if it already was.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// SystemClock is the real clock.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// WithTimeout is like context.WithTimeout, with the deadline measured on
+// clock.
+func WithTimeout(parent context.Context, clock Clock, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if clock == SystemClock {
+		return context.WithTimeout(parent, timeout)
+	}
+	ctx := &clockContext{parent: parent, done: make(chan struct{}), deadline: clock.Now().Add(timeout)}
+	if deadline, ok := parent.Deadline(); ok && deadline.Before(ctx.deadline) {
+		ctx.deadline = deadline
+	}
+	// Both are set before the context can be done, since done waits on the
+	// lock.
+	ctx.lock.Lock()
+	ctx.stopTimer = clock.AfterFunc(timeout, func() { ctx.finish(context.DeadlineExceeded) })
+	ctx.stopParent = context.AfterFunc(parent, func() { ctx.finish(parent.Err()) })
+	ctx.lock.Unlock()
+	return ctx, func() { ctx.finish(context.Canceled) }
+}
+
+// clockContext is a context whose deadline is measured on a Clock.
+type clockContext struct {
+	parent   context.Context
+	done     chan struct{}
+	deadline time.Time
+
+	lock       sync.Mutex
+	err        error
+	stopTimer  func() bool
+	stopParent func() bool
+}
+
+func (c *clockContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func (c *clockContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *clockContext) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.err
+}
+
+func (c *clockContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// finish makes the context done with err, unless it already is.
+func (c *clockContext) finish(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.stopTimer()
+	c.stopParent()
+}
@@ -0,0 +1,18 @@
+package iface
+
+import "context"
+
+type remoteAddrKey struct{}
+
+// WithRemoteAddr returns a copy of ctx which carries addr, the address a
+// request was received from.
+func WithRemoteAddr(ctx context.Context, addr Address) context.Context {
+	return context.WithValue(ctx, remoteAddrKey{}, addr)
+}
+
+// RemoteAddr returns the address the request handled with ctx was received
+// from, if the network knows it.
+func RemoteAddr(ctx context.Context) (Address, bool) {
+	addr, ok := ctx.Value(remoteAddrKey{}).(Address)
+	return addr, ok
+}
@@ -1,6 +1,9 @@
 package iface
 
-import "strconv"
+import (
+	"context"
+	"strconv"
+)
 
 type Proto int
 
@@ -32,9 +35,14 @@ func (a Address) String() string {
 	return a.IP + ":" + strconv.Itoa(a.Port)
 }
 
+// Net is the network used by a DHT to talk to its peers. Requests give up
+// with the context's error once ctx is done.
 type Net interface {
-	Get(addr Address, path string) ([]byte, error)
-	Put(addr Address, path string, data []byte) error
-	Post(addr Address, path string, data []byte) ([]byte, error)
-	Listen(addr Address, handler func(string, []byte) []byte, shutdown chan bool) error
+	Get(ctx context.Context, addr Address, path string) ([]byte, error)
+	Put(ctx context.Context, addr Address, path string, data []byte) error
+	Post(ctx context.Context, addr Address, path string, data []byte) ([]byte, error)
+	// Listen serves requests to addr with handler until shutdown. The context
+	// passed to handler is done when the request is cancelled by its sender,
+	// and carries the address of the sender if known, see RemoteAddr.
+	Listen(addr Address, handler func(context.Context, string, []byte) []byte, shutdown chan bool) error
 }
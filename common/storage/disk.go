@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DiskStorage is a Storage which keeps every key in a file of Dir, so that the
+// data outlives the process. It is safe for concurrent use.
+type DiskStorage struct {
+	Dir string
+}
+
+var _ Storage = &DiskStorage{}
+
+func (s *DiskStorage) Init() {}
+
+// path returns the file of key. Keys are hex encoded, so that any key makes a
+// valid file name inside Dir.
+func (s *DiskStorage) path(key string) string {
+	return filepath.Join(s.Dir, hex.EncodeToString([]byte(key)))
+}
+
+func (s *DiskStorage) Store(key string, data []byte) error {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	// The data is written aside and then renamed, so that a crash never
+	// leaves a truncated value behind.
+	path := s.path(key)
+	tmp, err := ioutil.TempFile(s.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *DiskStorage) Fetch(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("key %q not found in storage", key)
+	}
+	return data, err
+}
+
+func (s *DiskStorage) Empty() error {
+	return os.RemoveAll(s.Dir)
+}
@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestDiskStorage(t *testing.T) {
+	dir := t.TempDir()
+	s := &DiskStorage{Dir: dir}
+	s.Init()
+	if err := s.Store("../key", []byte("value")); err != nil {
+		t.Fatalf("error while storing: %v", err)
+	}
+
+	// The data is found again by another instance, as after a restart.
+	restarted := &DiskStorage{Dir: dir}
+	restarted.Init()
+	data, err := restarted.Fetch("../key")
+	if err != nil {
+		t.Fatalf("error while fetching: %v", err)
+	}
+	if string(data) != "value" {
+		t.Fatalf("expected %q, got %q", "value", data)
+	}
+
+	if err := restarted.Empty(); err != nil {
+		t.Fatalf("error while emptying: %v", err)
+	}
+	if _, err := restarted.Fetch("../key"); err == nil {
+		t.Fatalf("expected no data after emptying")
+	}
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MemStorage is a Storage which keeps data in memory. It is safe for
+// concurrent use.
+type MemStorage struct {
+	data map[string][]byte
+	lock sync.RWMutex
+}
+
+var _ Storage = &MemStorage{}
+
+func (m *MemStorage) Init() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.data = map[string][]byte{}
+}
+
+func (m *MemStorage) Store(key string, data []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.data[key] = data
+	return nil
+}
+
+func (m *MemStorage) Fetch(key string) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if data, ok := m.data[key]; ok {
+		return data, nil
+	}
+	return nil, fmt.Errorf("key %q not found in storage", key)
+}
+
+func (m *MemStorage) Empty() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.data = map[string][]byte{}
+	return nil
+}
@@ -2,10 +2,14 @@ package httpnet
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/sakshamsharma/sarga/common/iface"
@@ -18,33 +22,43 @@ type HTTPNet struct {
 
 var _ iface.Net = &HTTPNet{}
 
-func (n *HTTPNet) Get(addr iface.Address, path string) ([]byte, error) {
-	resp, err := http.Get("http://" + addr.String() + "/" + path)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+func (n *HTTPNet) Get(ctx context.Context, addr iface.Address, path string) ([]byte, error) {
+	return n.do(ctx, http.MethodGet, addr, path, nil)
 }
 
-func (n *HTTPNet) Put(addr iface.Address, path string, data []byte) error {
-	bufReader := ioutil.NopCloser(bytes.NewBuffer(data))
-	_, err := http.Post("http://"+addr.String()+"/"+path, "text/plain", bufReader)
+func (n *HTTPNet) Put(ctx context.Context, addr iface.Address, path string, data []byte) error {
+	_, err := n.do(ctx, http.MethodPost, addr, path, data)
 	return err
 }
 
-func (n *HTTPNet) Post(addr iface.Address, path string, data []byte) ([]byte, error) {
-	bufReader := ioutil.NopCloser(bytes.NewBuffer(data))
-	resp, err := http.Post("http://"+addr.String()+"/"+path, "text/plain", bufReader)
+func (n *HTTPNet) Post(ctx context.Context, addr iface.Address, path string, data []byte) ([]byte, error) {
+	return n.do(ctx, http.MethodPost, addr, path, data)
+}
+
+// do sends a request to path on addr, and returns the body of the response.
+// The request is aborted once ctx is done.
+func (n *HTTPNet) do(ctx context.Context, method string, addr iface.Address, path string, data []byte) ([]byte, error) {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+addr.String()+"/"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
+
 	defer resp.Body.Close()
 	return ioutil.ReadAll(resp.Body)
 }
 
-func (n *HTTPNet) Listen(addr iface.Address, handler func(string, []byte) []byte, shutdown chan bool) error {
+func (n *HTTPNet) Listen(addr iface.Address, handler func(context.Context, string, []byte) []byte, shutdown chan bool) error {
 	s := &http.Server{
 		Addr:    addr.String(),
 		Handler: &httphandler{handler},
@@ -68,7 +82,7 @@ func (n *HTTPNet) Listen(addr iface.Address, handler func(string, []byte) []byte
 }
 
 type httphandler struct {
-	handler func(string, []byte) []byte
+	handler func(context.Context, string, []byte) []byte
 }
 
 func (h *httphandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -89,6 +103,20 @@ func (h *httphandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		rw.Write([]byte("Could not read request body"))
 	} else {
 		// TODO: Catch error
-		_, _ = rw.Write(h.handler(path, body))
+		_, _ = rw.Write(h.handler(remoteContext(req), path, body))
+	}
+}
+
+// remoteContext returns the context of req, carrying the address req was
+// received from.
+func remoteContext(req *http.Request) context.Context {
+	host, port, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.Context()
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return req.Context()
 	}
+	return iface.WithRemoteAddr(req.Context(), iface.Address{IP: host, Port: p})
 }
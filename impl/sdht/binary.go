@@ -0,0 +1,212 @@
+package sdht
+
+import (
+	"time"
+
+	"github.com/sakshamsharma/sarga/common/iface"
+)
+
+// Binary encodings of the messages sent on the wire, see binaryCodec. Fields
+// are written in the order they are declared in.
+
+func (e envelope) writeBinary(w *binWriter) {
+	w.bytes(e.Key)
+	w.bytes(e.Body)
+	w.bytes(e.Signature)
+}
+
+func (e *envelope) readBinary(r *binReader) {
+	e.Key = r.bytes()
+	e.Body = r.bytes()
+	e.Signature = r.bytes()
+}
+
+func (m message) writeBinary(w *binWriter) {
+	w.varint(int64(m.Version))
+	w.string(m.Type)
+	w.uvarint(m.RequestID)
+	w.id(m.Sender)
+	w.id(m.Recipient)
+	w.time(m.Sent)
+	w.bytes(m.Body)
+}
+
+func (m *message) readBinary(r *binReader) {
+	m.Version = int(r.varint())
+	m.Type = r.string()
+	m.RequestID = r.uvarint()
+	m.Sender = r.id()
+	m.Recipient = r.id()
+	m.Sent = r.time()
+	m.Body = r.bytes()
+}
+
+func (s response) writeBinary(w *binWriter) {
+	w.varint(int64(s.Status))
+	w.string(s.Message)
+	w.bytes(s.Body)
+}
+
+func (s *response) readBinary(r *binReader) {
+	s.Status = status(r.varint())
+	s.Message = r.string()
+	s.Body = r.bytes()
+}
+
+func (q storeReq) writeBinary(w *binWriter) {
+	w.id(q.ID)
+	w.string(q.Key)
+	w.bytes(q.Data)
+	w.time(q.Published)
+	w.varint(int64(q.TTL))
+	w.bool(q.Cached)
+	w.bool(q.Mutable)
+}
+
+func (q *storeReq) readBinary(r *binReader) {
+	q.ID = r.id()
+	q.Key = r.string()
+	q.Data = r.bytes()
+	q.Published = r.time()
+	q.TTL = time.Duration(r.varint())
+	q.Cached = r.bool()
+	q.Mutable = r.bool()
+}
+
+func (storeResp) writeBinary(w *binWriter) {}
+
+func (*storeResp) readBinary(r *binReader) {}
+
+func (q findNodeReq) writeBinary(w *binWriter) {
+	w.peers([]Peer{q.Asker})
+	w.string(q.Key)
+}
+
+func (q *findNodeReq) readBinary(r *binReader) {
+	if asker := r.peers(); len(asker) == 1 {
+		q.Asker = asker[0]
+	} else if r.err == nil {
+		r.fail("asker")
+	}
+	q.Key = r.string()
+}
+
+func (s findNodeResp) writeBinary(w *binWriter) {
+	w.peers(s.Peers)
+	w.addr(s.Observed)
+}
+
+func (s *findNodeResp) readBinary(r *binReader) {
+	s.Peers = r.peers()
+	s.Observed = r.addr()
+}
+
+func (q findValueReq) writeBinary(w *binWriter) {
+	w.id(q.ID)
+	w.string(q.Key)
+}
+
+func (q *findValueReq) readBinary(r *binReader) {
+	q.ID = r.id()
+	q.Key = r.string()
+}
+
+func (s findValueResp) writeBinary(w *binWriter) {
+	w.bytes(s.Data)
+	w.peers(s.Peers)
+}
+
+func (s *findValueResp) readBinary(r *binReader) {
+	s.Data = r.bytes()
+	s.Peers = r.peers()
+}
+
+func (q exitReq) writeBinary(w *binWriter) {
+	w.id(q.ID)
+}
+
+func (q *exitReq) readBinary(r *binReader) {
+	q.ID = r.id()
+}
+
+func (s exitResp) writeBinary(w *binWriter) {
+	w.id(s.ID)
+}
+
+func (s *exitResp) readBinary(r *binReader) {
+	s.ID = r.id()
+}
+
+func (q addProviderReq) writeBinary(w *binWriter) {
+	w.id(q.ID)
+	w.string(q.Key)
+	w.addr(q.Provider)
+	w.varint(int64(q.TTL))
+}
+
+func (q *addProviderReq) readBinary(r *binReader) {
+	q.ID = r.id()
+	q.Key = r.string()
+	q.Provider = r.addr()
+	q.TTL = time.Duration(r.varint())
+}
+
+func (addProviderResp) writeBinary(w *binWriter) {}
+
+func (*addProviderResp) readBinary(r *binReader) {}
+
+func (q getProvidersReq) writeBinary(w *binWriter) {
+	w.id(q.ID)
+	w.string(q.Key)
+}
+
+func (q *getProvidersReq) readBinary(r *binReader) {
+	q.ID = r.id()
+	q.Key = r.string()
+}
+
+func (s getProvidersResp) writeBinary(w *binWriter) {
+	w.uvarint(uint64(len(s.Providers)))
+	for _, addr := range s.Providers {
+		w.addr(addr)
+	}
+}
+
+func (s *getProvidersResp) readBinary(r *binReader) {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		// Every address takes more than a byte, so n is bogus.
+		r.fail("providers")
+		return
+	}
+	s.Providers = make([]iface.Address, 0, n)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		s.Providers = append(s.Providers, r.addr())
+	}
+}
+
+func (s pingResp) writeBinary(w *binWriter) {
+	w.id(s.ID)
+	w.addr(s.Observed)
+}
+
+func (s *pingResp) readBinary(r *binReader) {
+	s.ID = r.id()
+	s.Observed = r.addr()
+}
+
+func (s infoResp) writeBinary(w *binWriter) {
+	w.string(s.ID)
+	w.varint(int64(s.Port))
+	w.string(s.Storage)
+	w.string(s.Buckets)
+	w.string(s.Liveness)
+}
+
+func (s *infoResp) readBinary(r *binReader) {
+	s.ID = r.string()
+	s.Port = int(r.varint())
+	s.Storage = r.string()
+	s.Buckets = r.string()
+	s.Liveness = r.string()
+}
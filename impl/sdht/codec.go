@@ -0,0 +1,256 @@
+package sdht
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sakshamsharma/sarga/common/iface"
+)
+
+// Codec selects how an SDHT encodes the RPCs it sends. Responses are always
+// encoded like the request they answer, so nodes using different codecs can
+// talk to each other.
+type Codec int
+
+const (
+	// JSONCodec encodes messages as JSON. It is the default.
+	JSONCodec Codec = iota
+	// BinaryCodec encodes messages in a compact length-prefixed binary form,
+	// which avoids the base64 expansion of values in JSON.
+	BinaryCodec
+)
+
+// codec encodes and decodes the messages sent on the wire.
+type codec interface {
+	encode(msg interface{}) []byte
+	decode(data []byte, msg interface{}) error
+}
+
+// codec returns the codec to send RPCs with.
+func (d *SDHT) codec() codec {
+	if d.Codec == BinaryCodec {
+		return binaryCodec{}
+	}
+	return jsonCodec{}
+}
+
+// detectCodec returns the codec data was encoded with.
+func detectCodec(data []byte) codec {
+	if len(data) != 0 && data[0] == binaryMagic {
+		return binaryCodec{}
+	}
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) encode(msg interface{}) []byte {
+	return marshal(msg)
+}
+
+func (jsonCodec) decode(data []byte, msg interface{}) error {
+	return json.Unmarshal(data, msg)
+}
+
+// binaryMagic starts every binary encoded message. JSON messages start with
+// '{' instead.
+const binaryMagic = 0xb1
+
+// binaryWriter is implemented by the messages which have a binary encoding.
+type binaryWriter interface {
+	writeBinary(w *binWriter)
+}
+
+// binaryReader is implemented by pointers to the messages which have a binary
+// encoding.
+type binaryReader interface {
+	readBinary(r *binReader)
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) encode(msg interface{}) []byte {
+	m, ok := msg.(binaryWriter)
+	if !ok {
+		panic(fmt.Sprintf("sdht: no binary encoding for %T", msg))
+	}
+	w := &binWriter{buf: []byte{binaryMagic}}
+	m.writeBinary(w)
+	return w.buf
+}
+
+func (binaryCodec) decode(data []byte, msg interface{}) error {
+	m, ok := msg.(binaryReader)
+	if !ok {
+		return fmt.Errorf("no binary encoding for %T", msg)
+	}
+	if len(data) == 0 || data[0] != binaryMagic {
+		return errors.New("invalid binary message")
+	}
+	r := &binReader{data: data[1:]}
+	m.readBinary(r)
+	if r.err == nil && len(r.data) != 0 {
+		r.err = fmt.Errorf("%d trailing bytes after binary message", len(r.data))
+	}
+	return r.err
+}
+
+// binWriter appends the fields of a message to buf. Byte slices and strings
+// are prefixed with their length as a uvarint, and integers are varints.
+type binWriter struct {
+	buf []byte
+}
+
+func (w *binWriter) uvarint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *binWriter) varint(v int64) {
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+// bytes writes b prefixed with its length plus one, so that a nil slice,
+// written as 0, can be told apart from an empty one.
+func (w *binWriter) bytes(b []byte) {
+	if b == nil {
+		w.uvarint(0)
+		return
+	}
+	w.uvarint(uint64(len(b)) + 1)
+	w.buf = append(w.buf, b...)
+}
+
+func (w *binWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *binWriter) bool(b bool) {
+	if b {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *binWriter) id(id ID) {
+	w.buf = append(w.buf, id[:]...)
+}
+
+// time writes t as nanoseconds since the Unix epoch, or 0 for the zero time.
+func (w *binWriter) time(t time.Time) {
+	if t.IsZero() {
+		w.varint(0)
+		return
+	}
+	w.varint(t.UnixNano())
+}
+
+func (w *binWriter) addr(addr iface.Address) {
+	w.string(addr.IP)
+	w.varint(int64(addr.Port))
+}
+
+func (w *binWriter) peers(peers []Peer) {
+	w.uvarint(uint64(len(peers)))
+	for _, p := range peers {
+		w.id(p.ID)
+		w.addr(p.Addr)
+	}
+}
+
+// binReader reads the fields written by binWriter from data. The first error
+// is kept in err, after which every read returns the zero value.
+type binReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binReader) fail(what string) {
+	if r.err == nil {
+		r.err = fmt.Errorf("truncated binary message while reading %s", what)
+	}
+	r.data = nil
+}
+
+func (r *binReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail("uvarint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binReader) varint() int64 {
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail("varint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// next returns the next n bytes of data.
+func (r *binReader) next(n uint64, what string) []byte {
+	if r.err != nil || n > uint64(len(r.data)) {
+		r.fail(what)
+		return nil
+	}
+	b := r.data[:n:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *binReader) bytes() []byte {
+	n := r.uvarint()
+	if n == 0 {
+		return nil
+	}
+	return r.next(n-1, "bytes")
+}
+
+func (r *binReader) string() string {
+	return string(r.next(r.uvarint(), "string"))
+}
+
+func (r *binReader) bool() bool {
+	b := r.next(1, "bool")
+	return b != nil && b[0] != 0
+}
+
+func (r *binReader) id() ID {
+	id := ID{}
+	copy(id[:], r.next(uint64(len(id)), "ID"))
+	return id
+}
+
+func (r *binReader) time() time.Time {
+	if v := r.varint(); v != 0 {
+		return time.Unix(0, v)
+	}
+	return time.Time{}
+}
+
+func (r *binReader) addr() iface.Address {
+	return iface.Address{IP: r.string(), Port: int(r.varint())}
+}
+
+func (r *binReader) peers() []Peer {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		// Every peer takes more than a byte, so n is bogus.
+		r.fail("peers")
+		return nil
+	}
+	peers := make([]Peer, 0, n)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		peers = append(peers, Peer{ID: r.id(), Addr: r.addr()})
+	}
+	return peers
+}
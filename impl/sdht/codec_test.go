@@ -0,0 +1,105 @@
+package sdht
+
+import (
+	"crypto/ed25519"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sakshamsharma/sarga/common/iface"
+)
+
+func TestBinaryCodec(t *testing.T) {
+	peers := []Peer{
+		{ID: genID(), Addr: iface.Address{IP: "10.0.0.1", Port: 8080}},
+		{ID: genID(), Addr: iface.Address{IP: "", Port: 0}},
+	}
+	published := time.Unix(0, time.Now().UnixNano())
+	msgs := []struct {
+		msg interface{}
+		ret interface{}
+	}{
+		{envelope{Key: []byte{1}, Body: []byte{}, Signature: nil}, &envelope{}},
+		{message{Version: ProtocolVersion, Type: "store", RequestID: 7, Sender: genID(), Recipient: genID(), Sent: published, Body: []byte("body")}, &message{}},
+		{response{Status: statusNotFound, Message: "missing"}, &response{}},
+		{storeReq{genID(), marshalID(genID()), []byte("data\xff\x00"), published, time.Hour, true, true}, &storeReq{}},
+		{storeResp{}, &storeResp{}},
+		{findNodeReq{peers[0], marshalID(genID())}, &findNodeReq{}},
+		{findNodeResp{Peers: peers, Observed: peers[0].Addr}, &findNodeResp{}},
+		{findValueReq{genID(), marshalID(genID())}, &findValueReq{}},
+		{findValueResp{Data: []byte{}, Peers: peers}, &findValueResp{}},
+		{findValueResp{Data: nil, Peers: []Peer{}}, &findValueResp{}},
+		{exitReq{genID()}, &exitReq{}},
+		{exitResp{genID()}, &exitResp{}},
+		{addProviderReq{genID(), marshalID(genID()), peers[0].Addr, time.Hour}, &addProviderReq{}},
+		{addProviderResp{}, &addProviderResp{}},
+		{getProvidersReq{genID(), marshalID(genID())}, &getProvidersReq{}},
+		{getProvidersResp{Providers: []iface.Address{peers[0].Addr, peers[1].Addr}}, &getProvidersResp{}},
+		{pingResp{genID(), peers[0].Addr}, &pingResp{}},
+		{infoResp{"id", 80, "{}", "[]", "{}"}, &infoResp{}},
+	}
+
+	c := binaryCodec{}
+	for _, m := range msgs {
+		data := c.encode(m.msg)
+		if err := c.decode(data, m.ret); err != nil {
+			t.Fatalf("error while decoding %T: %v", m.msg, err)
+		}
+		if got := reflect.ValueOf(m.ret).Elem().Interface(); !reflect.DeepEqual(got, m.msg) {
+			t.Fatalf("expected %#v after a round trip, got %#v", m.msg, got)
+		}
+		if err := c.decode(data[:len(data)-1], m.ret); err == nil && len(data) > 1 {
+			t.Fatalf("expected an error decoding a truncated %T", m.msg)
+		}
+	}
+}
+
+// benchmarkRoundTrip measures sealing msg as a message for action
+// with c, and opening it again.
+func benchmarkRoundTrip(b *testing.B, c codec, action string, msg, ret interface{}) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	d := &SDHT{key: key, id: idFromKey(key.Public().(ed25519.PublicKey)), Clock: iface.SystemClock}
+
+	b.SetBytes(chunkSize)
+	size := 0
+	for i := 0; i < b.N; i++ {
+		data := d.sealMessage(c, action, requestDomain(action), 1, d.id, msg)
+		m, _, err := openMessage(action, requestDomain(action), data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := m.codec.decode(m.Body, ret); err != nil {
+			b.Fatal(err)
+		}
+		size = len(data)
+	}
+	b.ReportMetric(float64(size), "wire-bytes/op")
+}
+
+// chunkSize is the size of the chunks stored by the apiserver.
+const chunkSize = 1024 * 1024
+
+func chunk() []byte {
+	data := make([]byte, chunkSize)
+	rand.Read(data)
+	return data
+}
+
+func BenchmarkStoreJSON(b *testing.B) {
+	req := storeReq{ID: genID(), Key: marshalID(genID()), Data: chunk(), Published: time.Now(), TTL: time.Hour}
+	benchmarkRoundTrip(b, jsonCodec{}, "store", req, &storeReq{})
+}
+
+func BenchmarkStoreBinary(b *testing.B) {
+	req := storeReq{ID: genID(), Key: marshalID(genID()), Data: chunk(), Published: time.Now(), TTL: time.Hour}
+	benchmarkRoundTrip(b, binaryCodec{}, "store", req, &storeReq{})
+}
+
+func BenchmarkFindValueRespJSON(b *testing.B) {
+	benchmarkRoundTrip(b, jsonCodec{}, "find_value_local", findValueResp{Data: chunk()}, &findValueResp{})
+}
+
+func BenchmarkFindValueRespBinary(b *testing.B) {
+	benchmarkRoundTrip(b, binaryCodec{}, "find_value_local", findValueResp{Data: chunk()}, &findValueResp{})
+}
@@ -1,25 +1,90 @@
 package sdht
 
 import (
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math/bits"
 	"math/rand"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/sakshamsharma/sarga/impl/slog"
 )
 
-const dhtK = 1
+// DefaultK is the bucket size, and the number of closest peers returned by
+// lookups, used when SDHT.K is not set.
+const DefaultK = 20
 const numBuckets = 160
 
 // ID is the representation of the type used for the key in the DHT.
 type ID [20]byte
 
 func (id ID) String() string {
-	return id.toBitString()[:10]
+	return fmt.Sprintf("%.8b%.8b", id[0], id[1])[:10]
+}
+
+// distance is the XOR distance between two IDs, read as a 160 bit big endian
+// unsigned integer.
+type distance [20]byte
+
+// xor returns the distance between id and other.
+func (id ID) xor(other ID) distance {
+	ret := distance{}
+	for i := range id {
+		ret[i] = id[i] ^ other[i]
+	}
+	return ret
+}
+
+// cmp returns -1, 0 or 1 if a is respectively smaller than, equal to or
+// larger than b.
+func (a distance) cmp(b distance) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+// prefixLen returns the number of leading zero bits of the distance, which is
+// the length of the prefix shared by the two IDs.
+func (a distance) prefixLen() int {
+	for i, b := range a {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return numBuckets
+}
+
+// bucketIndex returns the index of the bucket other belongs to in the routing
+// table of id, that is the first bit in which they differ. It returns
+// numBuckets if both are equal.
+func (id ID) bucketIndex(other ID) int {
+	return id.xor(other).prefixLen()
+}
+
+// flipBit returns a copy of id with the i-th most significant bit flipped.
+func (id ID) flipBit(i int) ID {
+	id[i/8] ^= 0x80 >> uint(i%8)
+	return id
+}
+
+// bit returns the i-th most significant bit of id.
+func (id ID) bit(i int) byte {
+	return id[i/8] >> uint(7-i%8) & 1
+}
+
+// randomIDInBucket returns an ID drawn from r which falls in the given bucket
+// of the routing table of id, that is which shares exactly bucketNum leading
+// bits with id.
+func (id ID) randomIDInBucket(r *rand.Rand, bucketNum int) ID {
+	ret := ID{}
+	r.Read(ret[:])
+	for i := 0; i <= bucketNum; i++ {
+		if (ret.bit(i) == id.bit(i)) == (i == bucketNum) {
+			ret = ret.flipBit(i)
+		}
+	}
+	return ret
 }
 
 func unmarshalID(id string) (ID, error) {
@@ -68,83 +133,175 @@ func min(a, b int) int {
 	return b
 }
 
-func (id ID) toBitString() string {
-	arr := []string{}
-	for _, b := range id {
-		arr = append(arr, fmt.Sprintf("%.8b", b))
-	}
-	return strings.Join(arr, "")
-}
-
 // isBetter returns true if peer1 is closer to key than peer2.
 func isBetter(key ID, peer1, peer2 Peer) bool {
-	return dist(peer1.ID, key) < dist(peer2.ID, key)
+	return peer1.ID.xor(key).cmp(peer2.ID.xor(key)) < 0
 }
 
-func isBetterSlice(key ID, peer1, peer2 []Peer) bool {
-	l := min(len(peer1), len(peer2))
-	for i := 0; i < l; i++ {
-		if dist(peer1[i].ID, key) < dist(peer2[i].ID, key) {
-			return true
-		}
-		if dist(peer1[i].ID, key) > dist(peer2[i].ID, key) {
-			return false
-		}
-	}
-	return (len(peer1) > len(peer2)) && (len(peer2) < dhtK)
+// bucket struct handles the list of nodes stored in each bucket.
+type bucket struct {
+	// peers is ordered from the least recently seen peer to the most recently
+	// seen one, and holds at most k entries.
+	peers []Peer
+	// replacements caches peers seen while the bucket was full, most recently
+	// seen last. They are promoted when an entry of peers goes away.
+	replacements []Peer
+	k            int
+	log          *slog.SLog
+	// lastUsed is the last time a lookup was performed for an ID in the range
+	// of the bucket.
+	lastUsed time.Time
+	// checking is set while the least recently seen peer is being pinged.
+	checking bool
+
+	lock *sync.RWMutex
 }
 
-// dist returns the distance between two keys.
-func dist(id1, id2 ID) int {
-	id1bits := id1.toBitString()
-	id2bits := id2.toBitString()
-	for i := range id1bits {
-		if id1bits[i] != id2bits[i] {
-			return numBuckets - i
+// indexOf returns the position of id in peers, or -1.
+func indexOf(peers []Peer, id ID) int {
+	for i, p := range peers {
+		if p.ID == id {
+			return i
 		}
 	}
-	return 0
+	return -1
 }
 
-// bucket struct handles the list of nodes stored in each bucket.
-type bucket struct {
-	peers       map[ID]Peer
-	replacement *Peer
-
-	lock *sync.RWMutex
+// remove returns peers without the entry at index i, preserving order.
+func remove(peers []Peer, i int) []Peer {
+	return append(peers[:i:i], peers[i+1:]...)
 }
 
-func (b *bucket) insert(owner ID, node Peer) {
+// insert records node as the most recently seen peer of the bucket. If the
+// bucket is full, node is cached as a replacement instead, and the least
+// recently seen peer is returned for the caller to ping; it is only evicted in
+// favour of node if it does not respond, see checked. No peer is returned
+// while the previous one is still being pinged. It returns true if node was
+// neither a peer nor a replacement of the bucket before.
+func (b *bucket) insert(owner ID, node Peer) (bool, *Peer) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	if len(b.peers) < dhtK {
-		if _, ok := b.peers[node.ID]; !ok {
-			log.Println(slog.VVerbose, owner, "added peer", node.ID)
-			b.peers[node.ID] = node
-		}
-	} else {
-		b.replacement = &node
+	if i := indexOf(b.peers, node.ID); i >= 0 {
+		b.peers = append(remove(b.peers, i), node)
+		return false, nil
+	}
+	if len(b.peers) < b.k {
+		b.log.Println(slog.VVerbose, owner, "added peer", node.ID)
+		b.add(node)
+		return true, nil
 	}
+	seen := indexOf(b.replacements, node.ID) < 0
+	b.addReplacement(node)
+	if b.checking {
+		return seen, nil
+	}
+	b.checking = true
+	oldest := b.peers[0]
+	return seen, &oldest
 }
 
-func (b *bucket) del(id ID) {
+// checked records the outcome of pinging p, the peer returned by insert. If p
+// responded, it becomes the most recently seen peer. Otherwise it is evicted in
+// favour of the most recently seen replacement, which is returned.
+func (b *bucket) checked(owner ID, p Peer, err error) *Peer {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	delete(b.peers, id)
+	b.checking = false
+	i := indexOf(b.peers, p.ID)
+	if i < 0 {
+		return nil
+	}
+	if err == nil {
+		seen := b.peers[i]
+		b.peers = append(remove(b.peers, i), seen)
+		return nil
+	}
+	b.log.Println(slog.Verbose, owner, "evicting unresponsive peer", p.ID)
+	b.peers = remove(b.peers, i)
+	return b.promote(owner)
+}
+
+// add appends node as the most recently seen peer, dropping it from the
+// replacements. Caller must hold the lock.
+func (b *bucket) add(node Peer) {
+	if i := indexOf(b.replacements, node.ID); i >= 0 {
+		b.replacements = remove(b.replacements, i)
+	}
+	b.peers = append(b.peers, node)
+}
+
+// addReplacement caches node in the replacement list. Caller must hold the
+// lock.
+func (b *bucket) addReplacement(node Peer) {
+	if i := indexOf(b.replacements, node.ID); i >= 0 {
+		b.replacements = remove(b.replacements, i)
+	}
+	b.replacements = append(b.replacements, node)
+	if len(b.replacements) > b.k {
+		b.replacements = b.replacements[len(b.replacements)-b.k:]
+	}
+}
+
+// del removes id from the bucket. Caller must hold the lock.
+func (b *bucket) del(id ID) {
+	if i := indexOf(b.peers, id); i >= 0 {
+		b.peers = remove(b.peers, i)
+	}
+	if i := indexOf(b.replacements, id); i >= 0 {
+		b.replacements = remove(b.replacements, i)
+	}
 }
 
+// replace removes id from the bucket and promotes the most recently seen
+// replacement, if any.
 func (b *bucket) replace(owner ID, id ID) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
 	b.del(id)
-	if b.replacement != nil {
-		replacement := *b.replacement
-		b.replacement = nil
-		b.insert(owner, replacement)
+	b.promote(owner)
+}
+
+// promote moves the most recently seen replacement to the peers of the bucket
+// if there is room, and returns it. Caller must hold the lock.
+func (b *bucket) promote(owner ID) *Peer {
+	if len(b.replacements) == 0 || len(b.peers) >= b.k {
+		return nil
 	}
+	last := len(b.replacements) - 1
+	replacement := b.replacements[last]
+	b.replacements = b.replacements[:last]
+	b.log.Println(slog.VVerbose, owner, "promoted replacement peer", replacement.ID)
+	b.add(replacement)
+	return &replacement
+}
+
+// touch records that a lookup was performed in the range of the bucket at
+// now.
+func (b *bucket) touch(now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.lastUsed = now
+}
+
+// idleSince returns the last time a lookup was performed in the range of the
+// bucket.
+func (b *bucket) idleSince() time.Time {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.lastUsed
+}
+
+// list returns a copy of the peers in the bucket, least recently seen first.
+func (b *bucket) list() []Peer {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return append([]Peer{}, b.peers...)
 }
 
 func (b *bucket) Marshal() string {
@@ -152,8 +309,8 @@ func (b *bucket) Marshal() string {
 	defer b.lock.RUnlock()
 
 	tmpMap := map[string]string{}
-	for key, val := range b.peers {
-		tmpMap[marshalID(key)] = val.Addr.String()
+	for _, val := range b.peers {
+		tmpMap[marshalID(val.ID)] = val.Addr.String()
 	}
 	return string(marshal(tmpMap))
 }
@@ -162,35 +319,83 @@ func (b *bucket) Marshal() string {
 type buckets struct {
 	bs   [numBuckets]bucket
 	lock *sync.RWMutex
+
+	// difficulty is the crypto puzzle difficulty the IDs of peers must meet,
+	// see validID.
+	difficulty int
+	log        *slog.SLog
+
+	// check is called with the least recently seen peer of a full bucket when
+	// another peer is seen. It must ping the peer without blocking, and report
+	// the outcome to checked.
+	check func(Peer)
+	// seen is called with every peer newly added to the routing table, or to
+	// the replacements of a full bucket, and with every promoted replacement.
+	seen func(Peer)
 }
 
+// insert adds node to the routing table of owner, unless its ID does not meet
+// the crypto puzzle difficulty.
 func (b *buckets) insert(owner ID, node Peer) {
-	b.lock.Lock()
-	defer b.lock.Unlock()
+	b.lock.RLock()
+	defer b.lock.RUnlock()
 
-	obits := owner.toBitString()
-	nbits := node.ID.toBitString()
+	if !validID(node.ID, b.difficulty) {
+		b.log.Println(slog.Verbose, owner, "rejected peer", node.ID, "whose ID does not meet difficulty", b.difficulty)
+		return
+	}
+	if i := owner.bucketIndex(node.ID); i < numBuckets {
+		seen, oldest := b.bs[i].insert(owner, node)
+		if seen && b.seen != nil {
+			b.seen(node)
+		}
+		if oldest != nil && b.check != nil {
+			b.check(*oldest)
+		}
+	}
+}
 
-	for i := 0; i < numBuckets; i++ {
-		if nbits[i] != obits[i] {
-			b.bs[i].insert(owner, node)
-			return
+// checked records the outcome of pinging p, which was passed to check.
+func (b *buckets) checked(owner ID, p Peer, err error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if i := owner.bucketIndex(p.ID); i < numBuckets {
+		if promoted := b.bs[i].checked(owner, p, err); promoted != nil && b.seen != nil {
+			b.seen(*promoted)
 		}
 	}
 }
 
+// contains returns whether id is one of the peers of the routing table, not
+// counting replacements.
+func (b *buckets) contains(owner ID, id ID) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if i := owner.bucketIndex(id); i < numBuckets {
+		return indexOf(b.bs[i].list(), id) >= 0
+	}
+	return false
+}
+
 // TODO(pallavag): Add locks around non atomic operations.
 func (b *buckets) replace(owner ID, id ID) {
-	b.lock.Lock()
-	defer b.lock.Unlock()
+	b.lock.RLock()
+	defer b.lock.RUnlock()
 
-	obits := owner.toBitString()
-	ibits := id.toBitString()
-	for i := 0; i < numBuckets; i++ {
-		if ibits[i] != obits[i] {
-			b.bs[i].replace(owner, id)
-			break
-		}
+	if i := owner.bucketIndex(id); i < numBuckets {
+		b.bs[i].replace(owner, id)
+	}
+}
+
+// touch records that a lookup was performed for key at now.
+func (b *buckets) touch(owner ID, key ID, now time.Time) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if i := owner.bucketIndex(key); i < numBuckets {
+		b.bs[i].touch(now)
 	}
 }
 
@@ -208,16 +413,36 @@ func (b *buckets) Marshal() string {
 	return string(marshal(tmpList))
 }
 
-func initBuckets() buckets {
+// all returns a copy of every peer in the routing table.
+func (b *buckets) all() []Peer {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	peers := []Peer{}
+	for i := range b.bs {
+		peers = append(peers, b.bs[i].list()...)
+	}
+	return peers
+}
+
+// initBuckets returns an empty routing table whose buckets were last used at
+// now.
+func initBuckets(k, difficulty int, now time.Time, check func(Peer), seen func(Peer), log *slog.SLog) buckets {
 	bs := [numBuckets]bucket{}
 	for i := 0; i < numBuckets; i++ {
 		bs[i] = bucket{
-			lock:  &sync.RWMutex{},
-			peers: make(map[ID]Peer),
+			lock:     &sync.RWMutex{},
+			k:        k,
+			log:      log,
+			lastUsed: now,
 		}
 	}
 	return buckets{
-		lock: &sync.RWMutex{},
-		bs:   bs,
+		lock:       &sync.RWMutex{},
+		bs:         bs,
+		difficulty: difficulty,
+		log:        log,
+		check:      check,
+		seen:       seen,
 	}
 }
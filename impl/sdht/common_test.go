@@ -0,0 +1,104 @@
+package sdht
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/sakshamsharma/sarga/impl/slog"
+)
+
+func TestBucketEviction(t *testing.T) {
+	b := bucket{k: 2, lock: &sync.RWMutex{}, log: &slog.SLog{}}
+	p1, p2, p3, p4 := Peer{ID: ID{1}}, Peer{ID: ID{2}}, Peer{ID: ID{3}}, Peer{ID: ID{4}}
+
+	b.insert(ID{}, p1)
+	b.insert(ID{}, p2)
+	// Seeing p1 again makes it the most recently seen peer.
+	b.insert(ID{}, p1)
+	if got := b.list(); got[0].ID != p2.ID || got[1].ID != p1.ID {
+		t.Fatalf("expected LRU order [p2 p1], got %v", got)
+	}
+
+	// p3 is cached as a replacement right away, and p2 is to be pinged.
+	seen, oldest := b.insert(ID{}, p3)
+	if !seen || oldest == nil || oldest.ID != p2.ID {
+		t.Fatalf("expected p2 to be pinged before p3 is added, got %v, %v", seen, oldest)
+	}
+	if got := b.list(); indexOf(got, p3.ID) >= 0 || indexOf(b.replacements, p3.ID) < 0 {
+		t.Fatalf("expected p3 to be a replacement, got %v and %v", got, b.replacements)
+	}
+	// Only one ping is in flight at a time.
+	if _, oldest := b.insert(ID{}, p4); oldest != nil {
+		t.Fatalf("expected no other ping while p2 is pinged, got %v", oldest)
+	}
+
+	// p2 answers the ping, so it becomes the most recently seen peer.
+	if promoted := b.checked(ID{}, p2, nil); promoted != nil {
+		t.Fatalf("expected no replacement to be promoted, got %v", promoted)
+	}
+	if got := b.list(); got[0].ID != p1.ID || got[1].ID != p2.ID {
+		t.Fatalf("expected LRU order [p1 p2], got %v", got)
+	}
+
+	// p1 is now the oldest and does not answer, so the most recently seen
+	// replacement takes its place.
+	seen, oldest = b.insert(ID{}, p3)
+	if seen || oldest == nil || oldest.ID != p1.ID {
+		t.Fatalf("expected p1 to be pinged, got %v", oldest)
+	}
+	promoted := b.checked(ID{}, p1, errors.New("unreachable"))
+	if promoted == nil || promoted.ID != p3.ID {
+		t.Fatalf("expected p3 to be promoted, got %v", promoted)
+	}
+	if got := b.list(); indexOf(got, p1.ID) >= 0 || got[1].ID != p3.ID {
+		t.Fatalf("expected p1 to be evicted for p3, got %v", got)
+	}
+
+	b.replace(ID{}, p2.ID)
+	if got := b.list(); len(got) != 2 || got[0].ID != p3.ID || got[1].ID != p4.ID {
+		t.Fatalf("expected p4 to replace p2, got %v", got)
+	}
+}
+
+func TestDistance(t *testing.T) {
+	a := ID{0x80}
+	b := ID{0x81}
+	c := ID{0x01}
+
+	if got := a.bucketIndex(c); got != 0 {
+		t.Fatalf("expected bucket 0 for IDs differing in the first bit, got %d", got)
+	}
+	if got := a.bucketIndex(b); got != 7 {
+		t.Fatalf("expected bucket 7 for IDs differing in the eighth bit, got %d", got)
+	}
+	if got := a.bucketIndex(a); got != numBuckets {
+		t.Fatalf("expected %d for equal IDs, got %d", numBuckets, got)
+	}
+
+	// Neither shares a prefix with key, but a is closer.
+	key := ID{0x00, 0x01}
+	if !isBetter(key, Peer{ID: a}, Peer{ID: b}) {
+		t.Fatalf("expected %x to be closer to %x than %x", a, key, b)
+	}
+	if isBetter(key, Peer{ID: b}, Peer{ID: a}) {
+		t.Fatalf("expected %x to not be closer to %x than %x", b, key, a)
+	}
+
+	for i := 0; i < numBuckets; i++ {
+		if got := a.bucketIndex(a.flipBit(i)); got != i {
+			t.Fatalf("expected flipping bit %d to give bucket %d, got %d", i, i, got)
+		}
+	}
+}
+
+func TestRandomIDInBucket(t *testing.T) {
+	id := genID()
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < numBuckets; i++ {
+		if got := id.bucketIndex(id.randomIDInBucket(r, i)); got != i {
+			t.Fatalf("expected random ID to fall in bucket %d, got %d", i, got)
+		}
+	}
+}
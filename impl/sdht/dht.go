@@ -1,9 +1,15 @@
 package sdht
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math/rand"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/sakshamsharma/sarga/common/dht"
@@ -13,296 +19,605 @@ import (
 
 // SDHT is a minimal implementation of a DHT (dht.DHT) to be used with sarga.
 type SDHT struct {
+	// K is the bucket size, and the number of closest peers that lookups
+	// converge on. Defaults to DefaultK.
+	K int
+	// Alpha is the number of RPCs kept in flight by lookups. Defaults to
+	// DefaultAlpha.
+	Alpha int
+	// Paths is the number of disjoint paths followed by lookups, each keeping
+	// Alpha RPCs in flight. Following several paths makes it harder for
+	// malicious peers to steer lookups, at the cost of more RPCs. Defaults to
+	// DefaultPaths.
+	Paths int
+	// ReplicateInterval is how often held values are re-sent to the k closest
+	// nodes. Defaults to DefaultReplicateInterval.
+	ReplicateInterval time.Duration
+	// RepublishInterval is how often values published by this node are re-sent
+	// to the k closest nodes. Values stored without a TTL live slightly longer
+	// than it. Defaults to DefaultRepublishInterval.
+	RepublishInterval time.Duration
+	// MaxTTL bounds how long values and provider records stored by other nodes
+	// live after being published, so that they can not make this node hold
+	// them forever. Defaults to DefaultMaxTTL.
+	MaxTTL time.Duration
+	// RefreshInterval is how long a bucket can go without lookups in its range
+	// before it is refreshed. Defaults to DefaultRefreshInterval.
+	RefreshInterval time.Duration
+	// MaxFailures is the number of consecutive failed RPCs after which a peer
+	// is evicted. Defaults to DefaultMaxFailures.
+	MaxFailures int
+	// StaleTimeout is how long a peer can go unseen before it is pinged, and
+	// evicted if it does not answer. Defaults to DefaultStaleTimeout.
+	StaleTimeout time.Duration
+	// RPCTimeout bounds how long an RPC to a peer can take before it is
+	// considered failed. Defaults to DefaultRPCTimeout.
+	RPCTimeout time.Duration
+	// LeaveTimeout bounds how long Shutdown waits for stored keys to be handed
+	// off and for peers to acknowledge the exit. Defaults to
+	// DefaultLeaveTimeout.
+	LeaveTimeout time.Duration
+	// IdentityFile is where the identity of the node is kept across restarts.
+	// It is created on first run. If empty, a new identity is generated on
+	// every Init.
+	IdentityFile string
+	// RoutingTableFile is where the routing table is saved, periodically and
+	// on Shutdown. On Init, the live peers it lists are used as seeds, so that
+	// the node can rejoin even if its seeds are gone. Not saved if empty.
+	RoutingTableFile string
+	// SnapshotInterval is how often the routing table is saved. Defaults to
+	// DefaultSnapshotInterval.
+	SnapshotInterval time.Duration
+	// CacheTTL is how long a value found by a lookup is cached at the closest
+	// node on the lookup path which did not have it. It is halved for every
+	// node between that node and the key. Defaults to DefaultCacheTTL.
+	CacheTTL time.Duration
+	// Difficulty is the number of leading zero bits the hash of a node ID must
+	// have for the node to be added to the routing table, see validID. It must
+	// be the same on every node of a network. Disabled if 0.
+	Difficulty int
+	// ObservedQuorum is the number of peers which must report seeing requests
+	// of this node come from the same IP before it is advertised instead of
+	// the address the node listens on. Defaults to DefaultObservedQuorum.
+	ObservedQuorum int
+	// DiscoveryGroup is the UDP multicast group and port on which this node
+	// multicasts its beacon, and listens for the beacons of other nodes on the
+	// local network, which are added to the routing table. Discovery is
+	// disabled if the IP is empty.
+	DiscoveryGroup iface.Address
+	// DiscoveryInterface is the name of the network interface beacons are
+	// sent and received on. The system default is used if empty.
+	DiscoveryInterface string
+	// DiscoveryInterval is how often the beacon is multicast. Defaults to
+	// DefaultDiscoveryInterval.
+	DiscoveryInterval time.Duration
+	// Codec is how RPCs sent by this node are encoded. Defaults to JSONCodec.
+	Codec Codec
+	// LogLevel is the logging level of this instance. Defaults to slog.Error.
+	LogLevel slog.Level
+	// Clock tells the time to every timer, timeout and timestamp of the node,
+	// so that it can run on the virtual clock of a simulation. Defaults to
+	// iface.SystemClock.
+	Clock iface.Clock
+
+	log     slog.SLog
+	net     iface.Net
 	id      ID
+	key     ed25519.PrivateKey
 	addr    iface.Address
 	buckets buckets
 	store   Storage
-	alive   map[ID]int
-
-	shutdown chan bool
+	// rand picks the IDs buckets are refreshed with. It is seeded from the
+	// clock and the ID, so that simulated runs are reproducible.
+	rand *rand.Rand
+	// providers holds the provider records announced to this node.
+	providers providerStore
+	alive     map[ID]liveness
+	// aliveLock guards alive, which is updated by concurrent RPC handlers.
+	aliveLock sync.Mutex
+
+	// published holds the values originally stored by this node, which it
+	// keeps republishing.
+	published     map[string]record
+	publishedLock sync.Mutex
+	// providing holds the provider records announced by this node, which it
+	// keeps re-announcing.
+	providing     map[string]map[iface.Address]provider
+	providingLock sync.Mutex
+
+	shutdown     chan bool
+	shutdownOnce sync.Once
+	// stop is closed on Shutdown to terminate the background tasks, which are
+	// tracked by tasks. stopLock orders starting new tasks with closing stop,
+	// and starting new lookups with setting exiting.
+	stop     chan struct{}
+	stopLock sync.Mutex
+	tasks    sync.WaitGroup
+	// ctx is the context of the RPCs not sent on behalf of a caller, such as
+	// those of background tasks. cancel cancels it on Shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// observed holds the IP each peer last saw a request of this node come
+	// from, and external the address advertised from those reports, if any.
+	observed     map[ID]string
+	external     iface.Address
+	observedLock sync.Mutex
+	// requestID is the last request ID used.
+	requestID uint64
+	// seen holds the requests received which could still be replayed, until
+	// when they could be.
+	seen     map[seenRequest]time.Time
+	seenLock sync.Mutex
+
+	// inflight tracks the running lookups, and their RPCs still running,
+	// including those whose lookup already returned. No lookup is started once
+	// exiting is set, right before the exit is announced.
+	inflight sync.WaitGroup
+	exiting  bool
 }
 
 var _ dht.DHT = &SDHT{}
 
-var log = slog.SLog{
-	Level: slog.Error,
-}
-
-// SetLog sets the logging level for the whole package.
-func SetLog(level slog.Level) {
-	log.Level = level
-}
-
-// TODO: This should not remain global if we want to allow multiple instances
-// of SDHT.
-var network iface.Net
-
 func (d *SDHT) Init(addr iface.Address, seeds []iface.Address, net iface.Net) error {
-	d.id = genID()
-	d.store = make(Storage)
-	d.alive = map[ID]int{}
+	if d.LogLevel == slog.Zero {
+		d.LogLevel = slog.Error
+	}
+	d.log = slog.SLog{Level: d.LogLevel}
+	d.net = net
+	if d.Clock == nil {
+		d.Clock = iface.SystemClock
+	}
+	if d.IdentityFile != "" {
+		key, err := loadIdentity(d.IdentityFile, d.Difficulty)
+		if err != nil {
+			return fmt.Errorf("error while loading identity: %v", err)
+		}
+		d.key = key
+	} else {
+		key, err := generateKey(d.Difficulty)
+		if err != nil {
+			return err
+		}
+		d.key = key
+	}
+	d.id = idFromKey(d.key.Public().(ed25519.PublicKey))
+	d.rand = rand.New(rand.NewSource(d.Clock.Now().UnixNano() ^ int64(binary.BigEndian.Uint64(d.id[:]))))
+	d.store = newStorage(d.Clock.Now)
+	d.providers = newProviderStore()
+	d.alive = map[ID]liveness{}
+	d.observed = map[ID]string{}
+	d.seen = map[seenRequest]time.Time{}
+	d.requestID = firstRequestID()
 	d.addr = addr
-	d.buckets = initBuckets()
-	network = net
+	if d.K <= 0 {
+		d.K = DefaultK
+	}
+	if d.Alpha <= 0 {
+		d.Alpha = DefaultAlpha
+	}
+	if d.Paths <= 0 {
+		d.Paths = DefaultPaths
+	}
+	if d.ReplicateInterval <= 0 {
+		d.ReplicateInterval = DefaultReplicateInterval
+	}
+	if d.RepublishInterval <= 0 {
+		d.RepublishInterval = DefaultRepublishInterval
+	}
+	if d.MaxTTL <= 0 {
+		d.MaxTTL = DefaultMaxTTL
+	}
+	if d.RefreshInterval <= 0 {
+		d.RefreshInterval = DefaultRefreshInterval
+	}
+	if d.MaxFailures <= 0 {
+		d.MaxFailures = DefaultMaxFailures
+	}
+	if d.StaleTimeout <= 0 {
+		d.StaleTimeout = DefaultStaleTimeout
+	}
+	if d.RPCTimeout <= 0 {
+		d.RPCTimeout = DefaultRPCTimeout
+	}
+	if d.LeaveTimeout <= 0 {
+		d.LeaveTimeout = DefaultLeaveTimeout
+	}
+	if d.SnapshotInterval <= 0 {
+		d.SnapshotInterval = DefaultSnapshotInterval
+	}
+	if d.ObservedQuorum <= 0 {
+		d.ObservedQuorum = DefaultObservedQuorum
+	}
+	if d.DiscoveryInterval <= 0 {
+		d.DiscoveryInterval = DefaultDiscoveryInterval
+	}
+	if d.CacheTTL <= 0 {
+		d.CacheTTL = DefaultCacheTTL
+	}
+	d.published = map[string]record{}
+	d.providing = map[string]map[iface.Address]provider{}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	// Peers are pinged in the background, so that inserting a peer never
+	// waits on the network.
+	check := func(p Peer) {
+		d.background(func(ctx context.Context) {
+			err := d.pingPeer(ctx, p)
+			if ctx.Err() != nil {
+				// The ping was cut short by the shutdown of this node, which
+				// says nothing of the peer: evicting it would keep it from
+				// hearing of the exit.
+				err = nil
+			}
+			d.buckets.checked(d.id, p, err)
+			if err != nil {
+				d.forget(p.ID)
+			}
+		})
+	}
+	d.buckets = initBuckets(d.K, d.Difficulty, d.Clock.Now(), check, d.transferKeys, &d.log)
+	d.shutdown = make(chan bool)
+	d.stop = make(chan struct{})
 
-	log.Println(slog.Debug, d.id, "starting init at", addr)
+	d.log.Println(slog.Debug, d.id, "starting init at", addr)
+	if d.DiscoveryGroup.IP != "" {
+		if err := d.startDiscovery(); err != nil {
+			return fmt.Errorf("error while starting discovery: %v", err)
+		}
+	}
 	go d.serve()
 
 	for _, seed := range seeds {
 		root := &Peer{ID{}, seed}
-		if err := root.Ping(); err != nil {
-			log.Printf(slog.Debug, "%v errored while pinging %v: %v", d.id, root.ID, err)
+		if err := root.Ping(d.ctx, d); err != nil {
+			d.log.Printf(slog.Debug, "%v errored while pinging %v: %v", d.id, root.ID, err)
 			continue
 		}
 		// If ping was successful, root.ID should now be filled.
-		log.Println(slog.Debug, d.id, "realized about", root.ID)
+		d.log.Println(slog.Debug, d.id, "realized about", root.ID)
 
 		d.buckets.insert(d.id, *root)
-		d.findClosestPeers(marshalID(d.id), true)
+		d.findClosestPeers(d.ctx, marshalID(d.id), true)
+	}
+
+	joined := len(seeds) != 0
+	if d.RoutingTableFile != "" && len(d.loadRoutingTable(d.ctx)) != 0 {
+		d.findClosestPeers(d.ctx, marshalID(d.id), true)
+		joined = true
 	}
 
-	if len(seeds) != 0 {
-		for i, bucket := range d.buckets.bs {
-			if len(bucket.peers) != 0 {
+	if joined {
+		for i := range d.buckets.bs {
+			if len(d.buckets.bs[i].list()) != 0 {
 				break
 			}
 
 			reprKey := d.getRepresentativeBucketID(i)
-			log.Println(slog.Verbose, d.id, "trying to fill bucket", i, "using key", reprKey)
-			d.findClosestPeers(marshalID(reprKey), true)
+			d.log.Println(slog.Verbose, d.id, "trying to fill bucket", i, "using key", reprKey)
+			d.findClosestPeers(d.ctx, marshalID(reprKey), true)
 		}
 	}
 
-	d.shutdown = make(chan bool)
+	d.every(d.ReplicateInterval, d.replicate)
+	d.every(d.RepublishInterval, d.republish)
+	d.every(expireInterval, func(context.Context) { d.expire() })
+	d.every(d.RefreshInterval, d.refresh)
+	d.every(d.StaleTimeout, d.evictStale)
+	if d.RoutingTableFile != "" {
+		d.every(d.SnapshotInterval, func(context.Context) { d.saveRoutingTable() })
+	}
 	return nil
 }
 
+// getRepresentativeBucketID returns an ID which falls in the given bucket.
 func (d *SDHT) getRepresentativeBucketID(bucketNum int) ID {
-	outputBits := []byte(d.id.toBitString())
-	if outputBits[bucketNum] == '1' {
-		outputBits[bucketNum] = '0'
-	} else {
-		outputBits[bucketNum] = '1'
-	}
-	outputBytes := [20]byte{}
-	for i, _ := range outputBytes {
-		var b byte
-		fmt.Sscanf(string(outputBits[:8]), "%b", &b)
-		outputBits = outputBits[8:]
-		outputBytes[i] = b
-	}
-	return outputBytes
+	return d.id.flipBit(bucketNum)
 }
 
+// Shutdown stops the background tasks of the SDHT, leaves the network
+// gracefully, and stops serving requests. Calling it again has no effect.
 func (d *SDHT) Shutdown() {
-	d.shutdown <- true
+	d.shutdownOnce.Do(func() {
+		if d.RoutingTableFile != "" {
+			d.saveRoutingTable()
+		}
+		// No new lookups are started by background tasks while leaving, and
+		// the RPCs of running ones are cancelled.
+		d.stopLock.Lock()
+		close(d.stop)
+		d.stopLock.Unlock()
+		d.cancel()
+		d.tasks.Wait()
+		d.leave()
+		d.shutdown <- true
+	})
+}
+
+// background runs task in a background task, unless the SDHT is shut down.
+// The context passed to task is cancelled on Shutdown.
+func (d *SDHT) background(task func(context.Context)) {
+	d.stopLock.Lock()
+	defer d.stopLock.Unlock()
+
+	select {
+	case <-d.stop:
+		return
+	default:
+	}
+	d.tasks.Add(1)
+	go func() {
+		defer d.tasks.Done()
+		task(d.ctx)
+	}()
 }
 
-func (d *SDHT) Respond(action string, data []byte) []byte {
+// every starts a background task which runs task every interval on the clock,
+// until the SDHT is shut down.
+func (d *SDHT) every(interval time.Duration, task func(context.Context)) {
+	d.background(func(ctx context.Context) {
+		for {
+			tick := make(chan struct{})
+			stop := d.Clock.AfterFunc(interval, func() { close(tick) })
+			select {
+			case <-d.stop:
+				stop()
+				return
+			case <-tick:
+				task(ctx)
+			}
+		}
+	})
+}
+
+// Respond handles an RPC. Requests, except for ping and info, must be
+// envelopes signed by the node they claim to come from, and are dropped
+// otherwise. Responses, except for info, are signed by this node. The lookup
+// run for find_value is abandoned once ctx is done.
+func (d *SDHT) Respond(ctx context.Context, action string, data []byte) []byte {
+	// The response is sent with the codec and the request ID of the request,
+	// to its sender, once it is opened.
+	requestID, recipient := uint64(0), ID{}
+	var c codec = jsonCodec{}
+	// observed is reported back to the sender in ping and find_node.
+	observed, _ := iface.RemoteAddr(ctx)
+	resp := func(msg interface{}) []byte {
+		return d.sealMessage(c, action, responseDomain(action), requestID, recipient,
+			response{Status: statusOK, Body: c.encode(msg)})
+	}
+	fail := func(err error) []byte {
+		d.log.Println(slog.Debug, d.id, "failed", action, "request:", err)
+		return d.sealMessage(c, action, responseDomain(action), requestID, recipient,
+			response{Status: statusOf(err), Message: err.Error()})
+	}
+	// open unseals the request into req, and checks that it was signed by the
+	// node with the claimed ID, and is not a replay.
+	open := func(req interface{}, claimed func() ID) error {
+		msg, sender, err := openMessage(action, requestDomain(action), data)
+		if err == nil {
+			err = msg.codec.decode(msg.Body, req)
+		}
+		if err == nil && sender != claimed() {
+			err = fmt.Errorf("request claims to be from %v but is signed by %v", claimed(), sender)
+		}
+		if err == nil {
+			err = d.checkRequest(msg)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		requestID, recipient, c = msg.RequestID, sender, msg.codec
+		return nil
+	}
+
 	switch action {
 	case "ping":
-		return marshal(pingResp{ID: d.id})
+		// Pings carry no request, so the response is sent as JSON to no one in
+		// particular.
+		return resp(pingResp{ID: d.id, Observed: observed})
 
 	case "find_value":
 		req := findValueReq{}
-		if err := json.Unmarshal(data, &req); err != nil {
-			return marshal(findValueResp{Error: err})
+		if err := open(&req, func() ID { return req.ID }); err != nil {
+			return fail(err)
 		}
 		keyID, _ := unmarshalID(req.Key)
-		log.Println(slog.Verbose, d.id, "was asked about FindValue for", keyID)
+		d.log.Println(slog.Verbose, d.id, "was asked about FindValue for", keyID)
 		d.setAliveTime(req.ID)
-		out, err := d.FindValue(req.Key)
+		out, err := d.FindValue(ctx, req.Key)
 		if err != nil {
-			return marshal(findValueResp{Error: err})
+			return fail(err)
 		}
-		return marshal(findValueResp{Data: out})
+		return resp(findValueResp{Data: out})
 
 	case "find_value_local":
 		req := findValueReq{}
-		if err := json.Unmarshal(data, &req); err != nil {
-			return marshal(findValueResp{Error: err})
+		if err := open(&req, func() ID { return req.ID }); err != nil {
+			return fail(err)
 		}
 		keyID, _ := unmarshalID(req.Key)
-		log.Println(slog.Verbose, d.id, "was asked about FindValueLocal for", keyID)
+		d.log.Println(slog.Verbose, d.id, "was asked about FindValueLocal for", keyID)
 		d.setAliveTime(req.ID)
 		out, peers, err := d.findValue(req.Key)
 		if err != nil {
-			return marshal(findValueResp{Error: err})
+			return fail(err)
 		}
-		return marshal(findValueResp{Data: out, Peers: peers})
+		return resp(findValueResp{Data: out, Peers: peers})
 
 	case "find_node":
 		req := findNodeReq{}
-		if err := json.Unmarshal(data, &req); err != nil {
-			return marshal(findNodeResp{Error: err})
+		if err := open(&req, func() ID { return req.Asker.ID }); err != nil {
+			return fail(err)
 		}
 		d.setAlive(req.Asker)
 		peers, err := d.findNode(req.Key)
 		if err != nil {
-			return marshal(findNodeResp{Error: err})
+			return fail(err)
 		}
-		return marshal(findNodeResp{Peers: peers})
+		return resp(findNodeResp{Peers: peers, Observed: observed})
 
 	case "store":
 		req := storeReq{}
-		if err := json.Unmarshal(data, &req); err != nil {
-			log.Println(slog.Error, err)
-			return nil
+		if err := open(&req, func() ID { return req.ID }); err != nil {
+			return fail(err)
 		}
 		d.setAliveTime(req.ID)
 		keyID, _ := unmarshalID(req.Key)
-		log.Println(slog.Verbose, d.id, "is storing key", keyID)
-		d.store.Set(req.Key, []byte(req.Data))
+		if req.Published.After(d.Clock.Now().Add(maxClockSkew)) {
+			return fail(fmt.Errorf("%w: value published in the future at %v", ErrBadRequest, req.Published))
+		}
+		rec := record{
+			Data:      req.Data,
+			Published: req.Published,
+			TTL:       req.TTL,
+			Cached:    req.Cached,
+			Mutable:   req.Mutable,
+		}
+		if req.Mutable {
+			mutable, err := dht.UnmarshalMutableRecord(req.Key, rec.Data)
+			if err != nil {
+				return fail(fmt.Errorf("%w: %v", ErrBadRequest, err))
+			}
+			rec.Seq = mutable.Seq
+		}
+		if rec.TTL > d.MaxTTL {
+			rec.TTL = d.MaxTTL
+		}
+		d.log.Println(slog.Verbose, d.id, "is storing key", keyID)
+		if err := d.store.Set(req.Key, rec); err != nil {
+			return fail(err)
+		}
+		return resp(storeResp{})
+
+	case "add_provider":
+		req := addProviderReq{}
+		if err := open(&req, func() ID { return req.ID }); err != nil {
+			return fail(err)
+		}
+		d.setAliveTime(req.ID)
+		keyID, _ := unmarshalID(req.Key)
+		ttl := req.TTL
+		if ttl <= 0 {
+			ttl = d.defaultTTL()
+		}
+		if ttl > d.MaxTTL {
+			ttl = d.MaxTTL
+		}
+		d.log.Println(slog.Verbose, d.id, "is storing provider", req.Provider, "of key", keyID)
+		d.providers.add(req.Key, req.Provider, d.Clock.Now().Add(ttl))
+		return resp(addProviderResp{})
+
+	case "get_providers":
+		req := getProvidersReq{}
+		if err := open(&req, func() ID { return req.ID }); err != nil {
+			return fail(err)
+		}
+		d.setAliveTime(req.ID)
+		return resp(getProvidersResp{Providers: d.providers.get(req.Key, d.Clock.Now())})
 
 	case "exit":
 		req := exitReq{}
-		if err := json.Unmarshal(data, &req); err != nil {
-			log.Println(slog.Error, err)
-			return nil
+		if err := open(&req, func() ID { return req.ID }); err != nil {
+			return fail(err)
 		}
+		d.log.Println(slog.Verbose, d.id, "was told", req.ID, "is leaving")
 		d.recordExit(req.ID)
+		return resp(exitResp{ID: d.id})
 
 	case "info":
 		return marshal(infoResp{
-			ID:      marshalID(d.id),
-			Port:    d.addr.Port,
-			Storage: d.store.Marshal(),
-			Buckets: d.buckets.Marshal(),
+			ID:       marshalID(d.id),
+			Port:     d.addr.Port,
+			Storage:  d.store.Marshal(),
+			Buckets:  d.buckets.Marshal(),
+			Liveness: d.livenessInfo(),
 		})
 
 	default:
-		log.Println(slog.Error, "Request not recognized:", action)
+		d.log.Println(slog.Error, "Request not recognized:", action)
+		return fail(fmt.Errorf("%w: request not recognized: %s", ErrBadRequest, action))
 	}
-	return nil
 }
 
-func (d *SDHT) StoreValue(key string, data []byte) error {
+// StoreValue stores data at the k nodes closest to key, and keeps
+// republishing it every RepublishInterval. Stored copies expire ttl after they
+// were last published, or slightly more than RepublishInterval if ttl is not
+// positive.
+func (d *SDHT) StoreValue(ctx context.Context, key string, data []byte, ttl time.Duration) error {
 	keyID, _ := unmarshalID(key)
-	log.Println(slog.Verbose, d.id, "Sending StoreValue", keyID)
-	peers, err := d.findClosestPeers(key, false)
-	if err != nil {
-		return err
+	d.log.Println(slog.Verbose, d.id, "Sending StoreValue", keyID)
+
+	if ttl <= 0 {
+		ttl = d.defaultTTL()
 	}
+	return d.publish(ctx, key, record{
+		Data:      data,
+		Published: d.Clock.Now(),
+		TTL:       ttl,
+	})
+}
 
-	for _, p := range peers {
-		err := p.SendStore(d.id, key, data)
-		if err != nil {
-			return err
+// publish stores rec at the k closest nodes to key, and keeps republishing it
+// unless it was refused as conflicting.
+func (d *SDHT) publish(ctx context.Context, key string, rec record) error {
+	d.publishedLock.Lock()
+	d.published[key] = rec
+	d.publishedLock.Unlock()
+
+	err := d.storeAtClosest(ctx, key, rec, true)
+	if errors.Is(err, ErrConflict) {
+		d.publishedLock.Lock()
+		if cur, ok := d.published[key]; ok && bytes.Equal(cur.Data, rec.Data) {
+			delete(d.published, key)
 		}
+		d.publishedLock.Unlock()
 	}
-	return nil
+	return err
 }
 
-func (d *SDHT) FindValue(key string) ([]byte, error) {
+func (d *SDHT) FindValue(ctx context.Context, key string) ([]byte, error) {
 	keyID, _ := unmarshalID(key)
-	log.Println(slog.Verbose, d.id, "wants key", keyID)
-	data, peers, err := d.findValue(key)
+	d.log.Println(slog.Verbose, d.id, "wants key", keyID)
+	if val, err := d.store.Get(key); err == nil {
+		return val, nil
+	}
+
+	result, err := d.lookup(ctx, key, findFirstValue, false)
 	if err != nil {
 		return nil, err
 	}
-	if data != nil {
-		return data, nil
+	if result.data == nil {
+		return nil, fmt.Errorf("did not find the file corresponding to chunk %v: %w", key, ErrNotFound)
 	}
-
-	sort.Slice(peers, func(i, j int) bool {
-		return isBetter(keyID, peers[i], peers[j])
-	})
-
-	for {
-		hopPeers := []Peer{}
-		for _, p := range peers {
-			dataP, peersP, err := p.FindValue(d.id, key)
-			if dataP != nil {
-				return dataP, nil
-			}
-			if err != nil {
-				log.Println(slog.Error, d.id, "got an error contacting peer:", err)
-			} else {
-				hopPeers = append(hopPeers, peersP...)
-			}
-		}
-
-		sort.Slice(hopPeers, func(i, j int) bool {
-			return isBetter(keyID, hopPeers[i], hopPeers[j])
-		})
-
-		if !isBetterSlice(keyID, hopPeers, peers) {
-			return nil, fmt.Errorf("did not find the file corresponding to chunk %v", key)
-		}
-
-		peers = hopPeers[:min(len(hopPeers), dhtK)]
+	if result.cache != nil {
+		d.cacheValue(*result.cache, key, result.data, result.between)
 	}
+	return result.data, nil
 }
 
 func (d *SDHT) getPeer() Peer {
 	return Peer{
 		ID:   d.id,
-		Addr: d.addr,
+		Addr: d.advertisedAddr(),
 	}
 }
 
-func (d *SDHT) findClosestPeers(key string, insert bool) ([]Peer, error) {
-	keyID, _ := unmarshalID(key)
-	peers, err := d.findNode(key)
+// findClosestPeers returns the k peers closest to key which are alive.
+func (d *SDHT) findClosestPeers(ctx context.Context, key string, insert bool) ([]Peer, error) {
+	result, err := d.lookup(ctx, key, findNodes, insert)
 	if err != nil {
 		return nil, err
 	}
-
-	sort.Slice(peers, func(i, j int) bool {
-		return isBetter(keyID, peers[i], peers[j])
-	})
-	log.Println(slog.Verbose, d.id, "has peers", peers)
-
-	var peersUniq map[ID]Peer
-
-	for {
-		peersUniq = map[ID]Peer{}
-		for _, p := range peers {
-			peersUniq[p.ID] = p
-		}
-
-		hopPeers := []Peer{}
-		for _, p := range peersUniq {
-			peersP, err := p.FindNode(d.getPeer(), key)
-			if err != nil {
-				log.Println(slog.Verbose, d.id, "got an error contacting peer for findNode:", err)
-			}
-			hopPeers = append(hopPeers, peersP...)
-		}
-		for _, p := range hopPeers {
-			peersUniq[p.ID] = p
-		}
-
-		hopPeers = []Peer{}
-		for _, p := range peersUniq {
-			hopPeers = append(hopPeers, p)
-			if insert && p.ID != d.id {
-				d.buckets.insert(d.id, p)
-			}
-		}
-
-		sort.Slice(hopPeers, func(i, j int) bool {
-			return isBetter(keyID, hopPeers[i], hopPeers[j])
-		})
-
-		if !isBetterSlice(keyID, hopPeers, peers) {
-			break
-		}
-
-		peers = hopPeers[:min(len(hopPeers), dhtK)]
-	}
-
-	return peers[:min(len(peers), dhtK)], nil
+	d.log.Println(slog.Verbose, d.id, "has peers", result.closest)
+	return result.closest, nil
 }
 
 func (d *SDHT) findValue(key string) ([]byte, []Peer, error) {
 	//fmt.Println("findValue", marshalID(d.id), key)
 	if val, err := d.store.Get(key); err == nil {
-		log.Println(slog.Verbose, marshalID(d.id), "GOT THE VALUE FOR", key)
+		d.log.Println(slog.Verbose, marshalID(d.id), "GOT THE VALUE FOR", key)
 		return val, nil, nil
 	}
 	keyID, _ := unmarshalID(key)
-	log.Println(slog.VVerbose, d.id, "DID NOT GET THE VALUE FOR", keyID)
+	d.log.Println(slog.VVerbose, d.id, "DID NOT GET THE VALUE FOR", keyID)
 	peers, err := d.findNode(key)
 	if err == nil {
 		return nil, peers, nil
@@ -312,44 +627,46 @@ func (d *SDHT) findValue(key string) ([]byte, []Peer, error) {
 
 func (d *SDHT) findNode(key string) ([]Peer, error) {
 	//fmt.Println("findNode", marshalID(d.id), key)
-	buckets := d.buckets.bs
-	newBuckets := []Peer{}
+	newBuckets := d.buckets.all()
 
 	// TODO(pallavag): Remove unsafe unmarshals.
 	keyID, _ := unmarshalID(key)
-	for _, bs := range buckets {
-		for _, b := range bs.peers {
-			newBuckets = append(newBuckets, b)
-		}
-	}
 
 	//fmt.Println("Here", newBuckets)
 	sort.Slice(newBuckets, func(i, j int) bool {
 		return isBetter(keyID, newBuckets[i], newBuckets[j])
 	})
 
-	return newBuckets[:min(len(newBuckets), dhtK)], nil
+	return newBuckets[:min(len(newBuckets), d.K)], nil
+}
+
+// pingPeer checks that p is still reachable and still has the same ID.
+func (d *SDHT) pingPeer(ctx context.Context, p Peer) error {
+	q := Peer{Addr: p.Addr}
+	if err := q.Ping(ctx, d); err != nil {
+		return err
+	}
+	if q.ID != p.ID {
+		return fmt.Errorf("peer at %v changed ID from %v to %v", p.Addr, p.ID, q.ID)
+	}
+	d.setAliveTime(p.ID)
+	return nil
 }
 
 func (d *SDHT) setAlive(peer Peer) {
-	d.alive[peer.ID] = int(time.Now().Unix())
 	if d.id != peer.ID {
 		d.buckets.insert(d.id, peer)
 	}
-}
-
-func (d *SDHT) setAliveTime(id ID) {
-	d.alive[id] = int(time.Now().Unix())
+	d.setAliveTime(peer.ID)
 }
 
 func (d *SDHT) recordExit(id ID) {
-	delete(d.alive, id)
-	d.buckets.replace(d.id, id)
+	d.evict(id)
 }
 
 // TODO: Move this to apiserver.
 func (d *SDHT) serve() error {
-	return network.Listen(iface.Address{
+	return d.net.Listen(iface.Address{
 		IP:   "0.0.0.0",
 		Port: d.addr.Port,
 	}, d.Respond, d.shutdown)
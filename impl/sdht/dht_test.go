@@ -1,12 +1,21 @@
 package sdht
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/sakshamsharma/sarga/common/dht"
 	"github.com/sakshamsharma/sarga/common/iface"
 	"github.com/sakshamsharma/sarga/impl/testnet"
 )
@@ -20,26 +29,25 @@ func TestDHT(t *testing.T) {
 	//log.SetOutput(ioutil.Discard)
 	network := testnet.InitTestNet()
 
-	//rand.Seed(time.Now().UTC().UnixNano())
-	rand.Seed(0)
+	r := newTestRand(t)
 
 	nodeDHT := SDHT{}
 	addr := iface.Address{"0", 0}
-	network.DHTs[addr] = &nodeDHT
+	network.Add(addr, &nodeDHT)
 	nodeDHT.Init(addr, []iface.Address{}, network)
 
 	for i := 1; i < dhtCount; i++ {
 		nodeDHT := SDHT{}
 		addr := iface.Address{strconv.Itoa(i), 0}
-		network.DHTs[addr] = &nodeDHT
-		nodeDHT.Init(addr, []iface.Address{{strconv.Itoa(rand.Intn(i)), 0}}, network)
+		network.Add(addr, &nodeDHT)
+		nodeDHT.Init(addr, []iface.Address{{strconv.Itoa(r.Intn(i)), 0}}, network)
 	}
 
 	fmt.Println("**** INIT FINISHED **")
 
 	ii := marshalID(genID())
 
-	err := nodeDHT.StoreValue(ii, []byte(dataToStore))
+	err := nodeDHT.StoreValue(context.Background(), ii, []byte(dataToStore), 0)
 	if err != nil {
 		t.Fatalf("error while storing file in DHT: %v", err)
 	}
@@ -48,26 +56,1289 @@ func TestDHT(t *testing.T) {
 		ID:  nodeDHT.id,
 		Key: ii,
 	}
-	v, err := network.Post(iface.Address{strconv.Itoa(rand.Intn(dhtCount)), 0}, "find_value", marshal(reqData))
+	// Requests are sent to a given node, so its ID is learnt first.
+	target := Peer{Addr: iface.Address{strconv.Itoa(r.Intn(dhtCount)), 0}}
+	if err := target.Ping(context.Background(), &nodeDHT); err != nil {
+		t.Fatalf("error while pinging %v: %v", target.Addr, err)
+	}
+	v, err := network.Post(context.Background(), target.Addr, "find_value",
+		nodeDHT.sealMessage(jsonCodec{}, "find_value", requestDomain("find_value"), 1, target.ID, reqData))
 	if err != nil {
 		t.Fatalf("error while fetching file from DHT: %v", err)
 	}
 	resp := findValueResp{}
-	if err := json.Unmarshal(v, &resp); err != nil {
-		t.Fatalf("invalid JSON received as response to find_value: %v", err)
-	}
-	if resp.Error != nil {
-		t.Fatalf("node returned error in response to find_value: %v", resp.Error)
+	if err := readResponse("find_value", v, &resp); err != nil {
+		t.Fatalf("node returned error in response to find_value: %v", err)
 	}
 
 	if string(resp.Data) != dataToStore {
-		t.Fatalf("invalid data receieved from DHT, expected %q, got %q", dataToStore, v)
+		t.Fatalf("invalid data received from DHT, expected %q, got %q", dataToStore, v)
 	}
 
 	fmt.Println("ASKING for info now")
-	v, err = network.Get(iface.Address{"0", 0}, "info")
+	v, err = network.Get(context.Background(), iface.Address{"0", 0}, "info")
 	if err != nil {
 		t.Fatalf("error while fetching file from DHT: %v", err)
 	}
 	fmt.Println(string(v))
 }
+
+// newTestRand returns a random source seeded with 0, which node keys are also
+// generated from until the end of the test, so that the IDs of test nodes are
+// reproducible.
+func newTestRand(t *testing.T) *rand.Rand {
+	r := rand.New(rand.NewSource(0))
+	old := keyReader
+	keyReader = r
+	t.Cleanup(func() { keyReader = old })
+	return r
+}
+
+// initTestDHTs creates count SDHTs on a TestNet, each joining through an
+// earlier node picked with r. configure is applied to every SDHT before it is
+// initialized.
+func initTestDHTs(r *rand.Rand, count int, configure func(*SDHT)) (*testnet.TestNet, []*SDHT) {
+	network := testnet.InitTestNet()
+	return network, addTestDHTs(network, r, nil, count, configure)
+}
+
+// addTestDHTs adds count SDHTs to a TestNet already running dhts, each joining
+// through an earlier node picked with r, and returns all of them.
+func addTestDHTs(network *testnet.TestNet, r *rand.Rand, dhts []*SDHT, count int, configure func(*SDHT)) []*SDHT {
+	start := len(dhts)
+	for i := start; i < start+count; i++ {
+		nodeDHT := &SDHT{}
+		configure(nodeDHT)
+		addr := iface.Address{IP: strconv.Itoa(i), Port: 0}
+		network.Add(addr, nodeDHT)
+
+		seeds := []iface.Address{}
+		if i != 0 {
+			seeds = append(seeds, iface.Address{IP: strconv.Itoa(r.Intn(i)), Port: 0})
+		}
+		nodeDHT.Init(addr, seeds, network)
+		dhts = append(dhts, nodeDHT)
+	}
+	return dhts
+}
+
+// stopBackground stops the background tasks of every SDHT, and waits for them
+// to terminate, without leaving the network.
+func stopBackground(dhts []*SDHT) {
+	for _, d := range dhts {
+		d.stopLock.Lock()
+		close(d.stop)
+		d.stopLock.Unlock()
+		d.tasks.Wait()
+	}
+}
+
+// readResponse checks the signature and status of a response to action, and
+// unmarshals its body into ret.
+func readResponse(action string, data []byte, ret interface{}) error {
+	msg, _, err := openMessage(action, responseDomain(action), data)
+	if err != nil {
+		return err
+	}
+	return openResponse(msg, ret)
+}
+
+// answer returns the response of d carrying msg to data, a request for
+// action.
+func answer(d *SDHT, action string, data []byte, msg interface{}) []byte {
+	requestID, recipient := uint64(0), ID{}
+	if req, sender, err := openMessage(action, requestDomain(action), data); err == nil {
+		requestID, recipient = req.RequestID, sender
+	}
+	return d.sealMessage(jsonCodec{}, action, responseDomain(action), requestID, recipient,
+		response{Status: statusOK, Body: marshal(msg)})
+}
+
+// holders returns the SDHTs which have key in their storage.
+func holders(dhts []*SDHT, key string) []*SDHT {
+	ret := []*SDHT{}
+	for _, d := range dhts {
+		if _, err := d.store.Get(key); err == nil {
+			ret = append(ret, d)
+		}
+	}
+	return ret
+}
+
+// initTestValue creates count SDHTs as initTestDHTs does, with a new test
+// random source, and stores dataToStore from the first one under a new random
+// key, which it returns.
+func initTestValue(t *testing.T, count int, configure func(*SDHT)) (*testnet.TestNet, []*SDHT, string) {
+	t.Helper()
+	network, dhts := initTestDHTs(newTestRand(t), count, configure)
+	return network, dhts, storeTestValue(t, dhts[0])
+}
+
+// storeTestValue stores dataToStore from d under a new random key, and
+// returns the key.
+func storeTestValue(t *testing.T, d *SDHT) string {
+	t.Helper()
+	key := marshalID(genID())
+	if err := d.StoreValue(context.Background(), key, []byte(dataToStore), 0); err != nil {
+		t.Fatalf("error while storing file in DHT: %v", err)
+	}
+	return key
+}
+
+// checkTestValue checks that d finds dataToStore under key.
+func checkTestValue(t *testing.T, d *SDHT, key string) {
+	t.Helper()
+	data, err := d.FindValue(context.Background(), key)
+	if err != nil {
+		t.Fatalf("error while fetching file from DHT: %v", err)
+	}
+	if string(data) != dataToStore {
+		t.Fatalf("invalid data received from DHT, expected %q, got %q", dataToStore, data)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	const k = 3
+	const republish = 48 * time.Hour
+	_, dhts, key := initTestValue(t, dhtCount, func(d *SDHT) {
+		d.K = k
+		d.RepublishInterval = republish
+	})
+
+	stored := holders(dhts, key)
+	if len(stored) != k {
+		t.Fatalf("expected value to be stored at %d nodes, got %d", k, len(stored))
+	}
+	// Values must not expire between republishes.
+	if rec, _ := stored[0].store.GetRecord(key); rec.TTL <= republish {
+		t.Fatalf("expected a default TTL longer than the republish interval %v, got %v", republish, rec.TTL)
+	}
+
+	// One holder loses the value, and another one replicates it again.
+	stored[0].store.Del(key)
+	stored[1].replicate(context.Background())
+	if got := len(holders(dhts, key)); got != k {
+		t.Fatalf("expected value to be replicated back to %d nodes, got %d", k, got)
+	}
+
+	// All holders lose the value, and the publisher republishes it.
+	for _, d := range stored {
+		d.store.Del(key)
+	}
+	dhts[0].republish(context.Background())
+	if got := len(holders(dhts, key)); got != k {
+		t.Fatalf("expected value to be republished to %d nodes, got %d", k, got)
+	}
+}
+
+func TestStoreLimits(t *testing.T) {
+	r := newTestRand(t)
+	_, dhts := initTestDHTs(r, 10, func(d *SDHT) { d.K = 3 })
+	asker, target := dhts[1], dhts[0]
+	p := target.getPeer()
+
+	// Values can not be made to live longer than MaxTTL.
+	key := marshalID(genID())
+	rec := record{Data: []byte(dataToStore), Published: time.Now(), TTL: 100 * 365 * 24 * time.Hour}
+	if err := p.SendStore(context.Background(), asker, key, rec); err != nil {
+		t.Fatalf("error while storing at %v: %v", p.ID, err)
+	}
+	if got, _ := target.store.GetRecord(key); got.TTL != target.MaxTTL {
+		t.Fatalf("expected the TTL to be clamped to %v, got %v", target.MaxTTL, got.TTL)
+	}
+
+	// Nor by being published in the future.
+	key = marshalID(genID())
+	rec = record{Data: []byte(dataToStore), Published: time.Now().Add(100 * 365 * 24 * time.Hour), TTL: time.Hour}
+	if err := p.SendStore(context.Background(), asker, key, rec); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected a value published in the future to be a bad request, got %v", err)
+	}
+	if _, err := target.store.Get(key); err == nil {
+		t.Fatalf("expected a value published in the future to not be stored")
+	}
+}
+
+func TestBucketRefresh(t *testing.T) {
+	r := newTestRand(t)
+	_, dhts := initTestDHTs(r, dhtCount, func(d *SDHT) { d.K = 3 })
+
+	d := dhts[0]
+	stale := time.Now().Add(-2 * d.RefreshInterval)
+	for i := range d.buckets.bs {
+		d.buckets.bs[i].lastUsed = stale
+	}
+
+	d.refresh(context.Background())
+	if !d.buckets.bs[0].idleSince().After(stale) {
+		t.Fatalf("expected bucket 0 to be refreshed")
+	}
+	if d.buckets.bs[numBuckets-1].idleSince().After(stale) {
+		t.Fatalf("expected bucket %d to not be refreshed", numBuckets-1)
+	}
+
+	// Shutdown must terminate all the background tasks.
+	for _, d := range dhts {
+		d.Shutdown()
+	}
+}
+
+func TestLivenessEviction(t *testing.T) {
+	r := newTestRand(t)
+	network, dhts := initTestDHTs(r, dhtCount, func(d *SDHT) { d.K = 3 })
+
+	d := dhts[0]
+	peers := d.buckets.all()
+	if len(peers) < 2 {
+		t.Fatalf("expected at least 2 peers in the routing table, got %d", len(peers))
+	}
+
+	// A peer is only evicted after MaxFailures consecutive failures.
+	failing := peers[0]
+	for i := 0; i < d.MaxFailures; i++ {
+		if indexOf(d.buckets.all(), failing.ID) < 0 {
+			t.Fatalf("expected %v to be evicted only after %d failures, got %d", failing.ID, d.MaxFailures, i)
+		}
+		d.setFailed(failing)
+	}
+	if indexOf(d.buckets.all(), failing.ID) >= 0 {
+		t.Fatalf("expected %v to be evicted after %d failures", failing.ID, d.MaxFailures)
+	}
+
+	// Only the peers of the routing table are tracked.
+	stranger := genID()
+	d.setAliveTime(stranger)
+	d.setFailed(Peer{ID: stranger})
+	d.aliveLock.Lock()
+	_, strangerTracked := d.alive[stranger]
+	_, failingTracked := d.alive[failing.ID]
+	d.aliveLock.Unlock()
+	if strangerTracked || failingTracked {
+		t.Fatalf("expected only peers of the routing table to be tracked, got %v", d.livenessInfo())
+	}
+
+	// A stale peer which left the network is evicted, a stale live one is not.
+	gone, live := peers[1], peers[len(peers)-1]
+	network.Remove(gone.Addr)
+	d.aliveLock.Lock()
+	d.alive[gone.ID] = liveness{LastSeen: time.Now().Add(-2 * d.StaleTimeout)}
+	d.alive[live.ID] = liveness{LastSeen: time.Now().Add(-2 * d.StaleTimeout)}
+	d.aliveLock.Unlock()
+
+	d.evictStale(context.Background())
+	if indexOf(d.buckets.all(), gone.ID) >= 0 {
+		t.Fatalf("expected stale peer %v to be evicted", gone.ID)
+	}
+	if indexOf(d.buckets.all(), live.ID) < 0 {
+		t.Fatalf("expected live peer %v to be kept", live.ID)
+	}
+
+	resp := infoResp{}
+	if err := json.Unmarshal(d.Respond(context.Background(), "info", nil), &resp); err != nil {
+		t.Fatalf("invalid JSON received as response to info: %v", err)
+	}
+	if !strings.Contains(resp.Liveness, marshalID(live.ID)) {
+		t.Fatalf("expected liveness of %v in info response, got %s", live.ID, resp.Liveness)
+	}
+}
+
+func TestIndependentInstances(t *testing.T) {
+	r := newTestRand(t)
+	_, first := initTestDHTs(r, 10, func(d *SDHT) { d.K = 3 })
+	_, second := initTestDHTs(r, 10, func(d *SDHT) { d.K = 3 })
+
+	key := storeTestValue(t, first[0])
+
+	// Both networks use the same addresses, but must not see each other.
+	if got := len(holders(second, key)); got != 0 {
+		t.Fatalf("expected value to not reach the second DHT, got %d holders", got)
+	}
+	if _, err := second[0].FindValue(context.Background(), key); err == nil {
+		t.Fatalf("expected value to not be found in the second DHT")
+	}
+	checkTestValue(t, first[len(first)-1], key)
+}
+
+func TestGracefulLeave(t *testing.T) {
+	const k = 3
+	network, dhts, key := initTestValue(t, dhtCount, func(d *SDHT) { d.K = k })
+
+	// Every holder leaves in turn, handing the value off to the others.
+	for _, leaving := range holders(dhts, key) {
+		if leaving == dhts[0] {
+			continue
+		}
+		told := leaving.buckets.all()
+		leaving.Shutdown()
+		network.Remove(leaving.addr)
+		// Shutting down again has no effect, and no lookup is started anymore.
+		leaving.Shutdown()
+		if _, err := leaving.FindValue(context.Background(), marshalID(genID())); !errors.Is(err, errExiting) {
+			t.Fatalf("expected no lookup after leaving, got: %v", err)
+		}
+
+		remaining := []*SDHT{}
+		for _, d := range dhts {
+			if d != leaving {
+				remaining = append(remaining, d)
+			}
+		}
+		dhts = remaining
+
+		for _, d := range dhts {
+			if indexOf(told, d.id) >= 0 && indexOf(d.buckets.all(), leaving.id) >= 0 {
+				t.Fatalf("expected %v to have removed %v after its exit", d.id, leaving.id)
+			}
+		}
+		if got := len(holders(dhts, key)); got < k-1 {
+			t.Fatalf("expected value to be handed off to at least %d nodes, got %d", k-1, got)
+		}
+	}
+
+	checkTestValue(t, dhts[len(dhts)-1], key)
+}
+
+func TestProviderHandOff(t *testing.T) {
+	const k = 3
+	r := newTestRand(t)
+	network, dhts := initTestDHTs(r, dhtCount, func(d *SDHT) { d.K = k })
+	key := marshalID(genID())
+	addr := iface.Address{IP: "provider", Port: 80}
+	if err := dhts[0].AddProvider(context.Background(), key, addr, 0); err != nil {
+		t.Fatalf("error while announcing provider: %v", err)
+	}
+	providerHolders := func() []*SDHT {
+		ret := []*SDHT{}
+		for _, d := range dhts {
+			if len(d.providers.get(key, time.Now())) != 0 {
+				ret = append(ret, d)
+			}
+		}
+		return ret
+	}
+
+	// Every holder of the record leaves in turn, handing it off to the others.
+	for _, leaving := range providerHolders() {
+		if leaving == dhts[0] {
+			continue
+		}
+		leaving.Shutdown()
+		network.Remove(leaving.addr)
+		remaining := []*SDHT{}
+		for _, d := range dhts {
+			if d != leaving {
+				remaining = append(remaining, d)
+			}
+		}
+		dhts = remaining
+
+		if got := len(providerHolders()); got < k-1 {
+			t.Fatalf("expected the provider record to be handed off to at least %d nodes, got %d", k-1, got)
+		}
+	}
+
+	addrs, err := dhts[len(dhts)-1].FindProviders(context.Background(), key)
+	if err != nil || len(addrs) != 1 || addrs[0] != addr {
+		t.Fatalf("expected provider %v, got %v, %v", addr, addrs, err)
+	}
+}
+
+func TestKeyTransferOnJoin(t *testing.T) {
+	r := newTestRand(t)
+	const k = 5
+	network, dhts := initTestDHTs(r, 10, func(d *SDHT) { d.K = k })
+
+	keys := []string{}
+	for i := 0; i < 20; i++ {
+		keys = append(keys, storeTestValue(t, dhts[0]))
+	}
+
+	dhts = addTestDHTs(network, r, dhts, 40, func(d *SDHT) { d.K = k })
+	// Transfers happen in the background.
+	stopBackground(dhts)
+
+	for _, key := range keys {
+		keyID, _ := unmarshalID(key)
+		closest := dhts[0]
+		for _, d := range dhts {
+			if isBetter(keyID, d.getPeer(), closest.getPeer()) {
+				closest = d
+			}
+		}
+		if _, err := closest.store.Get(key); err != nil {
+			t.Fatalf("expected closest node %v to have been handed key %v", closest.id, keyID)
+		}
+	}
+}
+
+func TestKeyTransferToReplacement(t *testing.T) {
+	r := newTestRand(t)
+	const k = 2
+	_, dhts := initTestDHTs(r, 2, func(d *SDHT) { d.K = k })
+	stopBackground(dhts[1:])
+	holder, newcomer := dhts[0], dhts[1]
+	holder.evict(newcomer.id)
+
+	// The bucket of the newcomer is full of peers farther from the holder than
+	// the newcomer, which are not pinged, so that it only becomes a
+	// replacement.
+	holder.buckets.check = nil
+	for j := len(ID{})*8 - 1; len(holder.buckets.all()) < k; j-- {
+		mask := byte(1) << uint(7-j%8)
+		if (holder.id[j/8]^newcomer.id[j/8])&mask != 0 {
+			continue
+		}
+		far := newcomer.id
+		far[j/8] ^= mask
+		holder.buckets.insert(holder.id, Peer{ID: far, Addr: iface.Address{IP: "gone"}})
+	}
+
+	// The newcomer is among the k nodes closest to a key of the holder.
+	key := marshalID(holder.id)
+	holder.store.Set(key, record{Data: []byte(dataToStore), Published: time.Now(), TTL: time.Hour})
+	holder.buckets.insert(holder.id, newcomer.getPeer())
+	if indexOf(holder.buckets.all(), newcomer.id) >= 0 {
+		t.Fatalf("expected %v to be a replacement only", newcomer.id)
+	}
+	stopBackground(dhts[:1])
+	if _, err := newcomer.store.Get(key); err != nil {
+		t.Fatalf("expected the key to be transferred to the replacement %v", newcomer.id)
+	}
+}
+
+func TestWarmBootstrap(t *testing.T) {
+	dir := t.TempDir()
+	network, dhts, key := initTestValue(t, dhtCount, func(d *SDHT) { d.K = 3 })
+
+	// The node restarts with a saved routing table after its seed is gone.
+	addr := iface.Address{IP: "restarting", Port: 0}
+	restarting := &SDHT{
+		K:                3,
+		IdentityFile:     filepath.Join(dir, "identity.json"),
+		RoutingTableFile: filepath.Join(dir, "routing.json"),
+	}
+	network.Add(addr, restarting)
+	restarting.Init(addr, []iface.Address{dhts[1].addr}, network)
+	id := restarting.id
+	restarting.Shutdown()
+	network.Remove(addr)
+	dhts[1].Shutdown()
+	network.Remove(dhts[1].addr)
+
+	restarted := &SDHT{
+		K:                3,
+		IdentityFile:     filepath.Join(dir, "identity.json"),
+		RoutingTableFile: filepath.Join(dir, "routing.json"),
+	}
+	network.Add(addr, restarted)
+	restarted.Init(addr, nil, network)
+
+	if restarted.id != id {
+		t.Fatalf("expected restarted node to keep ID %v, got %v", id, restarted.id)
+	}
+	if indexOf(restarted.buckets.all(), dhts[1].id) >= 0 {
+		t.Fatalf("expected the gone seed to not be in the routing table")
+	}
+	checkTestValue(t, restarted, key)
+}
+
+func TestLookupCaching(t *testing.T) {
+	const k = 3
+	_, dhts, key := initTestValue(t, dhtCount, func(d *SDHT) { d.K = k })
+	originals := holders(dhts, key)
+
+	for _, d := range dhts {
+		checkTestValue(t, d, key)
+	}
+	// Caching happens in the background.
+	stopBackground(dhts)
+
+	cached := []*SDHT{}
+	for _, d := range holders(dhts, key) {
+		rec, _ := d.store.GetRecord(key)
+		if !rec.Cached {
+			continue
+		}
+		if rec.TTL > d.CacheTTL {
+			t.Fatalf("expected cached copy to live at most %v, got %v", d.CacheTTL, rec.TTL)
+		}
+		// At most the querier answered without the value closer to the key.
+		if rec.TTL < d.CacheTTL/2 {
+			t.Fatalf("expected cached copy to live at least %v, got %v", d.CacheTTL/2, rec.TTL)
+		}
+		cached = append(cached, d)
+	}
+	if len(cached) == 0 {
+		t.Fatalf("expected the value to be cached along lookup paths")
+	}
+	for _, d := range originals {
+		if rec, _ := d.store.GetRecord(key); rec.Cached {
+			t.Fatalf("expected original copy at %v to not be replaced by a cached one", d.id)
+		}
+	}
+
+	// Cached copies are not replicated.
+	for _, d := range originals {
+		d.store.Del(key)
+	}
+	for _, d := range cached {
+		d.replicate(context.Background())
+	}
+	for _, d := range originals {
+		if _, err := d.store.Get(key); err == nil {
+			t.Fatalf("expected cached copies to not be replicated to %v", d.id)
+		}
+	}
+}
+
+func TestRejectSpoofedID(t *testing.T) {
+	r := newTestRand(t)
+	network, dhts := initTestDHTs(r, 10, func(d *SDHT) { d.K = 3 })
+
+	// The spoofer signs with its own key, but claims the ID of another node.
+	spoofer, victim := dhts[1], dhts[2]
+	target := dhts[0]
+	req := findNodeReq{Peer{ID: victim.id, Addr: iface.Address{IP: "spoofer", Port: 0}}, marshalID(genID())}
+	v, err := network.Post(context.Background(), target.addr, "find_node", spoofer.sealMessage(jsonCodec{}, "find_node", requestDomain("find_node"), 1, target.id, req))
+	if err != nil {
+		t.Fatalf("error while sending find_node: %v", err)
+	}
+	if err := readResponse("find_node", v, &findNodeResp{}); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected spoofed request to be rejected as a bad request, got %v", err)
+	}
+	for _, p := range target.buckets.all() {
+		if p.ID == victim.id && p.Addr != victim.addr {
+			t.Fatalf("expected spoofed address %v to not be inserted for %v", p.Addr, victim.id)
+		}
+	}
+
+	// A request signed for another RPC is rejected too.
+	storeData := storeReq{ID: spoofer.id, Key: marshalID(genID()), Data: []byte(dataToStore), Published: time.Now(), TTL: time.Hour}
+	v, err = network.Post(context.Background(), target.addr, "store", spoofer.sealMessage(jsonCodec{}, "store", requestDomain("find_node"), 2, target.id, storeData))
+	if err != nil {
+		t.Fatalf("error while sending store: %v", err)
+	}
+	if err := readResponse("store", v, &storeResp{}); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected request signed for another RPC to be rejected as a bad request, got %v", err)
+	}
+	if _, err := target.store.Get(storeData.Key); err == nil {
+		t.Fatalf("expected request signed for another RPC to be rejected")
+	}
+}
+
+// impersonator answers lookups with the ID of another node at its own address.
+type impersonator struct {
+	*SDHT
+	victim Peer
+}
+
+func (m impersonator) Respond(_ context.Context, action string, data []byte) []byte {
+	resp := func(msg interface{}) []byte {
+		return answer(m.SDHT, action, data, msg)
+	}
+	switch action {
+	case "ping":
+		return resp(pingResp{ID: m.id})
+	case "find_node":
+		return resp(findNodeResp{Peers: []Peer{m.victim}})
+	}
+	return nil
+}
+
+func TestRejectMentionedSpoofedID(t *testing.T) {
+	r := newTestRand(t)
+	network, dhts := initTestDHTs(r, 10, func(d *SDHT) { d.K = 3 })
+	victim := dhts[1]
+
+	k, _ := generateKey(0)
+	addr := iface.Address{IP: "impersonator", Port: 0}
+	m := impersonator{&SDHT{key: k, id: idFromKey(k.Public().(ed25519.PublicKey)), Clock: iface.SystemClock}, Peer{ID: victim.id, Addr: addr}}
+	network.Add(addr, m)
+
+	// The querier joins through the impersonator, which claims that the
+	// victim is at its own address.
+	querier := &SDHT{K: 3}
+	querierAddr := iface.Address{IP: "querier", Port: 0}
+	network.Add(querierAddr, querier)
+	querier.Init(querierAddr, []iface.Address{addr}, network)
+	defer stopBackground([]*SDHT{querier})
+
+	found := false
+	for _, p := range querier.buckets.all() {
+		if p.ID == victim.id {
+			t.Fatalf("expected the victim to not be inserted at the address %v of the impersonator", p.Addr)
+		}
+		found = found || p.ID == m.id
+	}
+	if !found {
+		t.Fatalf("expected the impersonator to be inserted under its own ID")
+	}
+}
+
+func TestIDDifficulty(t *testing.T) {
+	r := newTestRand(t)
+	const difficulty = 6
+	network, dhts := initTestDHTs(r, 10, func(d *SDHT) {
+		d.K = 3
+		d.Difficulty = difficulty
+	})
+	for _, d := range dhts {
+		if !validID(d.id, difficulty) {
+			t.Fatalf("expected ID %v to meet difficulty %d", d.id, difficulty)
+		}
+	}
+
+	// The outsider did not solve the puzzle, but otherwise follows the protocol.
+	var outsiderKey ed25519.PrivateKey
+	for outsiderKey == nil || validID(idFromKey(outsiderKey.Public().(ed25519.PublicKey)), difficulty) {
+		outsiderKey, _ = generateKey(0)
+	}
+	path := filepath.Join(t.TempDir(), "identity.json")
+	ident := identity{ID: marshalID(idFromKey(outsiderKey.Public().(ed25519.PublicKey))), Key: outsiderKey}
+	if err := ioutil.WriteFile(path, marshal(ident), 0600); err != nil {
+		t.Fatalf("error while writing identity: %v", err)
+	}
+	outsider := &SDHT{K: 3, IdentityFile: path}
+	addr := iface.Address{IP: "outsider", Port: 0}
+	network.Add(addr, outsider)
+	outsider.Init(addr, []iface.Address{dhts[0].addr}, network)
+
+	for _, d := range dhts {
+		if indexOf(d.buckets.all(), outsider.id) >= 0 {
+			t.Fatalf("expected %v to reject outsider %v", d.id, outsider.id)
+		}
+	}
+
+	checkTestValue(t, dhts[9], storeTestValue(t, dhts[0]))
+}
+
+// liar answers lookups with the other liars, which are closer to the key than
+// any honest node, and never returns values.
+type liar struct {
+	*SDHT
+	liars *[]Peer
+}
+
+func (l liar) Respond(_ context.Context, action string, data []byte) []byte {
+	resp := func(msg interface{}) []byte {
+		return answer(l.SDHT, action, data, msg)
+	}
+	switch action {
+	case "ping":
+		return resp(pingResp{ID: l.id})
+	case "find_node":
+		return resp(findNodeResp{Peers: *l.liars})
+	case "find_value_local":
+		return resp(findValueResp{Peers: *l.liars})
+	}
+	return nil
+}
+
+func TestDisjointLookups(t *testing.T) {
+	network, dhts, key := initTestValue(t, 20, func(d *SDHT) { d.K = 3 })
+
+	// The liars have IDs closer to the key than any honest node.
+	keyID, _ := unmarshalID(key)
+	liars := []Peer{}
+	for i := 0; i < 3; i++ {
+		var k ed25519.PrivateKey
+		for k == nil || idFromKey(k.Public().(ed25519.PublicKey)).bucketIndex(keyID) < 12 {
+			k, _ = generateKey(0)
+		}
+		l := liar{&SDHT{key: k, id: idFromKey(k.Public().(ed25519.PublicKey)), Clock: iface.SystemClock}, &liars}
+		addr := iface.Address{IP: "liar" + strconv.Itoa(i), Port: 0}
+		network.Add(addr, l)
+		liars = append(liars, Peer{ID: l.id, Addr: addr})
+	}
+
+	// The querier only knows of a liar and of an honest node. Since the liar
+	// is the closest to the key, a single path only ever goes through liars.
+	for _, paths := range []int{1, 2} {
+		querier := &SDHT{K: 3, Alpha: 1, Paths: paths}
+		addr := iface.Address{IP: "querier" + strconv.Itoa(paths), Port: 0}
+		network.Add(addr, querier)
+		querier.Init(addr, nil, network)
+		querier.buckets.insert(querier.id, liars[0])
+		querier.buckets.insert(querier.id, dhts[1].getPeer())
+
+		if paths == 1 {
+			if _, err := querier.FindValue(context.Background(), key); err == nil {
+				t.Fatalf("expected a single path lookup to be steered by the liars")
+			}
+			continue
+		}
+		checkTestValue(t, querier, key)
+	}
+}
+
+// staller never answers RPCs, until they are cancelled by their sender.
+type staller struct {
+	*SDHT
+}
+
+func (s staller) Respond(ctx context.Context, action string, data []byte) []byte {
+	<-ctx.Done()
+	return nil
+}
+
+func TestCancelledLookup(t *testing.T) {
+	newTestRand(t)
+	network := testnet.InitTestNet()
+	k, _ := generateKey(0)
+	s := staller{&SDHT{key: k, id: idFromKey(k.Public().(ed25519.PublicKey)), Clock: iface.SystemClock}}
+	stallerAddr := iface.Address{IP: "staller", Port: 0}
+	network.Add(stallerAddr, s)
+
+	querier := &SDHT{K: 3, Alpha: 1, RPCTimeout: time.Hour}
+	addr := iface.Address{IP: "querier", Port: 0}
+	network.Add(addr, querier)
+	querier.Init(addr, nil, network)
+	querier.buckets.insert(querier.id, Peer{ID: s.id, Addr: stallerAddr})
+	key := marshalID(genID())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := querier.FindValue(ctx, key); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the lookup to give up at the deadline, got: %v", err)
+	}
+	if failures := querier.alive[s.id].Failures; failures != 0 {
+		t.Fatalf("expected the staller not to be blamed for the deadline, got %d failures", failures)
+	}
+
+	// Without a deadline, the RPC timeout keeps the lookup from hanging.
+	querier.RPCTimeout = 50 * time.Millisecond
+	if _, err := querier.FindValue(context.Background(), key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the lookup to time out on the staller, got: %v", err)
+	}
+	if failures := querier.alive[s.id].Failures; failures != 1 {
+		t.Fatalf("expected the staller to be marked as failed once, got %d failures", failures)
+	}
+}
+
+func TestProviders(t *testing.T) {
+	r := newTestRand(t)
+	_, dhts := initTestDHTs(r, dhtCount, func(d *SDHT) { d.K = 3 })
+	key := marshalID(genID())
+	first := iface.Address{IP: "provider1", Port: 80}
+	second := iface.Address{IP: "provider2", Port: 80}
+
+	if _, err := dhts[dhtCount-1].FindProviders(context.Background(), key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected no providers before any is announced, got: %v", err)
+	}
+	if err := dhts[0].AddProvider(context.Background(), key, first, 0); err != nil {
+		t.Fatalf("error while announcing provider: %v", err)
+	}
+	if err := dhts[1].AddProvider(context.Background(), key, second, 0); err != nil {
+		t.Fatalf("error while announcing provider: %v", err)
+	}
+	// Announcing the same provider again does not duplicate it.
+	if err := dhts[0].AddProvider(context.Background(), key, first, 0); err != nil {
+		t.Fatalf("error while announcing provider: %v", err)
+	}
+
+	addrs, err := dhts[dhtCount-1].FindProviders(context.Background(), key)
+	if err != nil {
+		t.Fatalf("error while finding providers: %v", err)
+	}
+	if len(addrs) != 2 || addrs[0] != first || addrs[1] != second {
+		t.Fatalf("expected providers %v and %v, got %v", first, second, addrs)
+	}
+
+	// Provider records expire, but are re-announced on republish.
+	for _, d := range dhts {
+		d.providers.expire(time.Now().Add(d.defaultTTL() + time.Minute))
+	}
+	if _, err := dhts[dhtCount-1].FindProviders(context.Background(), key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected provider records to expire, got: %v", err)
+	}
+	dhts[0].republish(context.Background())
+	addrs, err = dhts[dhtCount-1].FindProviders(context.Background(), key)
+	if err != nil {
+		t.Fatalf("error while finding providers: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0] != first {
+		t.Fatalf("expected the republished provider %v, got %v", first, addrs)
+	}
+
+	// Provider records announced with a TTL longer than MaxTTL are kept for
+	// MaxTTL only.
+	other := marshalID(genID())
+	if err := dhts[0].AddProvider(context.Background(), other, first, 100*DefaultMaxTTL); err != nil {
+		t.Fatalf("error while announcing provider: %v", err)
+	}
+	for _, d := range dhts {
+		d.providers.expire(time.Now().Add(d.MaxTTL + time.Minute))
+	}
+	if _, err := dhts[dhtCount-1].FindProviders(context.Background(), other); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected provider records to expire after MaxTTL, got: %v", err)
+	}
+}
+
+// natNet is a TestNet on which every request appears to come from public, like
+// requests of a node behind a NAT.
+type natNet struct {
+	*testnet.TestNet
+	public iface.Address
+}
+
+func (n natNet) Get(ctx context.Context, addr iface.Address, path string) ([]byte, error) {
+	return n.TestNet.Get(iface.WithRemoteAddr(ctx, n.public), addr, path)
+}
+
+func (n natNet) Post(ctx context.Context, addr iface.Address, path string, data []byte) ([]byte, error) {
+	return n.TestNet.Post(iface.WithRemoteAddr(ctx, n.public), addr, path, data)
+}
+
+func TestObservedAddress(t *testing.T) {
+	r := newTestRand(t)
+	network, _ := initTestDHTs(r, 10, func(d *SDHT) { d.K = 3 })
+
+	// The node is only reachable at its public address.
+	bind := iface.Address{IP: "0.0.0.0", Port: 7}
+	public := iface.Address{IP: "public", Port: 7}
+	d := &SDHT{K: 3}
+	network.Add(public, d)
+	d.Init(bind, []iface.Address{{IP: "0", Port: 0}}, natNet{network, iface.Address{IP: "public", Port: 4242}})
+	if addr := d.getPeer().Addr; addr != public {
+		t.Fatalf("expected the node to advertise %v, got %v", public, addr)
+	}
+
+	// Peers learn the public address from the node's requests, and can reach
+	// it there.
+	peer := &SDHT{K: 3}
+	peerAddr := iface.Address{IP: "peer", Port: 0}
+	network.Add(peerAddr, peer)
+	peer.Init(peerAddr, nil, network)
+	p := peer.getPeer()
+	if _, err := p.FindNode(context.Background(), d, marshalID(d.id)); err != nil {
+		t.Fatalf("error while contacting peer: %v", err)
+	}
+	known := peer.buckets.all()
+	if len(known) != 1 || known[0].Addr != public {
+		t.Fatalf("expected the peer to know the node at %v, got %v", public, known)
+	}
+	if err := peer.pingPeer(context.Background(), known[0]); err != nil {
+		t.Fatalf("expected the node to be reachable at its advertised address: %v", err)
+	}
+
+	// Reports are only trusted once enough peers agree.
+	d.external = iface.Address{}
+	d.observed = map[ID]string{}
+	for _, ip := range []string{"a", "a", "b", "b"} {
+		d.observe(genID(), iface.Address{IP: ip})
+	}
+	if addr := d.advertisedAddr(); addr != bind || d.ExternalIP() != "" {
+		t.Fatalf("expected disagreeing reports to be ignored, got %v", addr)
+	}
+	d.observe(genID(), iface.Address{IP: "a"})
+	if addr := d.advertisedAddr(); addr.IP != "a" || d.ExternalIP() != "a" {
+		t.Fatalf("expected the address reported by the most peers, got %v", addr)
+	}
+}
+
+func TestMutableRecords(t *testing.T) {
+	r := newTestRand(t)
+	_, dhts := initTestDHTs(r, dhtCount, func(d *SDHT) { d.K = 3 })
+	_, publisher, _ := ed25519.GenerateKey(nil)
+	salt := []byte("homepage")
+	key := dht.MutableKey(publisher.Public().(ed25519.PublicKey), salt)
+
+	v2 := dht.NewMutableRecord(publisher, salt, 2, []byte("v2"))
+	if err := dhts[0].StoreMutable(context.Background(), v2, 0); err != nil {
+		t.Fatalf("error while storing mutable record: %v", err)
+	}
+
+	// An older version sent by another node is refused.
+	v1 := dht.NewMutableRecord(publisher, salt, 1, []byte("v1"))
+	if err := dhts[1].StoreMutable(context.Background(), v1, 0); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected an older version to be refused as a conflict, got: %v", err)
+	}
+	// So is another version with the same sequence number.
+	other := dht.NewMutableRecord(publisher, salt, 2, []byte("other"))
+	if err := dhts[1].StoreMutable(context.Background(), other, 0); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected another version 2 to be refused as a conflict, got: %v", err)
+	}
+	// Neither is a version which is not signed by the publisher.
+	forged := v2
+	forged.Seq, forged.Value = 3, []byte("forged")
+	if err := dhts[2].StoreMutable(context.Background(), forged, 0); err == nil {
+		t.Fatalf("expected an error storing a forged record")
+	}
+	// Nor plain data under the key of the record.
+	if err := dhts[3].StoreValue(context.Background(), key, []byte("plain"), 0); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected plain data to be refused as a conflict, got: %v", err)
+	}
+
+	for _, d := range holders(dhts, key) {
+		rec, err := d.store.GetRecord(key)
+		if err != nil || !rec.Mutable || rec.Seq != 2 {
+			t.Fatalf("expected %v to hold version 2, got %+v, %v", d.id, rec, err)
+		}
+	}
+	rec, err := dhts[dhtCount-1].FindMutable(context.Background(), key)
+	if err != nil {
+		t.Fatalf("error while fetching mutable record: %v", err)
+	}
+	if rec.Seq != 2 || string(rec.Value) != "v2" {
+		t.Fatalf("expected version 2 %q, got version %d %q", "v2", rec.Seq, rec.Value)
+	}
+
+	v3 := dht.NewMutableRecord(publisher, salt, 3, []byte("v3"))
+	if err := dhts[4].StoreMutable(context.Background(), v3, 0); err != nil {
+		t.Fatalf("error while storing mutable record: %v", err)
+	}
+	rec, err = dhts[dhtCount-2].FindMutable(context.Background(), key)
+	if err != nil {
+		t.Fatalf("error while fetching mutable record: %v", err)
+	}
+	if rec.Seq != 3 || string(rec.Value) != "v3" {
+		t.Fatalf("expected version 3 %q, got version %d %q", "v3", rec.Seq, rec.Value)
+	}
+
+	// Stale versions held by most of the closest nodes do not hide the newest
+	// one held by the last of them.
+	stale := holders(dhts, key)
+	stale = stale[:len(stale)-1]
+	for _, d := range stale {
+		d.store.Del(key)
+		if err := d.store.Set(key, record{Data: v2.Marshal(), Published: time.Now(), TTL: time.Hour, Mutable: true, Seq: 2}); err != nil {
+			t.Fatalf("error while planting a stale version: %v", err)
+		}
+	}
+	rec, err = dhts[dhtCount-3].FindMutable(context.Background(), key)
+	if err != nil {
+		t.Fatalf("error while fetching mutable record: %v", err)
+	}
+	if rec.Seq != 3 {
+		t.Fatalf("expected version 3 despite %d stale holders, got version %d", len(stale), rec.Seq)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	r := newTestRand(t)
+	network, dhts := initTestDHTs(r, 10, func(d *SDHT) { d.K = 3 })
+	asker, target := dhts[1], dhts[0]
+
+	// A value lookup which fails is reported as not found.
+	req := findValueReq{ID: asker.id, Key: marshalID(genID())}
+	v, err := network.Post(context.Background(), target.addr, "find_value", asker.sealMessage(jsonCodec{}, "find_value", requestDomain("find_value"), 1, target.id, req))
+	if err != nil {
+		t.Fatalf("error while sending find_value: %v", err)
+	}
+	if err := readResponse("find_value", v, &findValueResp{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected missing value to be reported as not found, got %v", err)
+	}
+
+	// Stores report whether they succeeded.
+	p := target.getPeer()
+	key := marshalID(genID())
+	rec := record{Data: []byte(dataToStore), Published: time.Now(), TTL: time.Hour}
+	if err := p.SendStore(context.Background(), asker, key, rec); err != nil {
+		t.Fatalf("error while storing at %v: %v", p.ID, err)
+	}
+	rec.Mutable = true
+	if err := p.SendStore(context.Background(), asker, key, rec); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected unsigned mutable record to be a bad request, got %v", err)
+	}
+
+	for status, want := range map[status]error{
+		statusNotFound:   ErrNotFound,
+		statusBadRequest: ErrBadRequest,
+		statusOverloaded: ErrOverloaded,
+		statusInternal:   ErrInternal,
+		statusConflict:   ErrConflict,
+	} {
+		err := response{Status: status, Message: "failed"}.err()
+		if !errors.Is(err, want) || statusOf(err) != status {
+			t.Fatalf("expected status %d to map to %v and back, got %v", status, want, err)
+		}
+	}
+}
+
+func TestProtocolVersions(t *testing.T) {
+	r := newTestRand(t)
+	network, dhts := initTestDHTs(r, 10, func(d *SDHT) { d.K = 3 })
+	asker, target := dhts[1], dhts[0]
+
+	req := findNodeReq{asker.getPeer(), marshalID(genID())}
+	for _, version := range []int{1, 2, ProtocolVersion + 1} {
+		v, err := network.Post(context.Background(), target.addr, "find_node", asker.seal(jsonCodec{}, requestDomain("find_node"), message{
+			Version:   version,
+			Type:      "find_node",
+			RequestID: 42,
+			Sender:    asker.id,
+			Recipient: target.id,
+			Sent:      time.Now(),
+			Body:      marshal(req),
+		}))
+		if err != nil {
+			t.Fatalf("error while sending find_node: %v", err)
+		}
+		if err := readResponse("find_node", v, &findNodeResp{}); !errors.Is(err, ErrBadRequest) {
+			t.Fatalf("expected a version %d request to be a bad request, got %v", version, err)
+		}
+	}
+
+	// Bare requests, as sent before messages were introduced, are rejected too.
+	v, err := network.Post(context.Background(), target.addr, "find_node", asker.seal(jsonCodec{}, requestDomain("find_node"), req))
+	if err != nil {
+		t.Fatalf("error while sending find_node: %v", err)
+	}
+	if err := readResponse("find_node", v, &findNodeResp{}); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected a bare request to be a bad request, got %v", err)
+	}
+}
+
+func TestReplayedRequests(t *testing.T) {
+	r := newTestRand(t)
+	network, dhts := initTestDHTs(r, 10, func(d *SDHT) { d.K = 3 })
+	leaver, target, other := dhts[1], dhts[0], dhts[2]
+	req := exitReq{leaver.id}
+	post := func(to *SDHT, data []byte) error {
+		v, err := network.Post(context.Background(), to.addr, "exit", data)
+		if err != nil {
+			t.Fatalf("error while sending exit: %v", err)
+		}
+		return readResponse("exit", v, &exitResp{})
+	}
+
+	other.buckets.insert(other.id, leaver.getPeer())
+
+	exit := leaver.sealMessage(jsonCodec{}, "exit", requestDomain("exit"), 42, target.id, req)
+	if err := post(target, exit); err != nil {
+		t.Fatalf("node returned error in response to exit: %v", err)
+	}
+	if err := post(target, exit); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected a replayed exit to be a bad request, got %v", err)
+	}
+	if err := post(other, exit); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected an exit sent to another node to be a bad request, got %v", err)
+	}
+
+	stale := leaver.seal(jsonCodec{}, requestDomain("exit"), message{
+		Version:   ProtocolVersion,
+		Type:      "exit",
+		RequestID: 43,
+		Sender:    leaver.id,
+		Recipient: other.id,
+		Sent:      time.Now().Add(-2 * requestWindow),
+		Body:      marshal(req),
+	})
+	if err := post(other, stale); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected a stale exit to be a bad request, got %v", err)
+	}
+	if indexOf(other.buckets.all(), leaver.id) < 0 {
+		t.Fatalf("expected rejected exits to not evict %v", leaver.id)
+	}
+
+	// Every other RPC is protected the same way, so that a replayed store can
+	// not bring back data, nor a replayed add_provider a provider.
+	key := marshalID(genID())
+	for i, req := range []struct {
+		action string
+		msg    interface{}
+	}{
+		{"store", storeReq{ID: leaver.id, Key: key, Data: []byte(dataToStore), Published: time.Now(), TTL: time.Hour}},
+		{"add_provider", addProviderReq{leaver.id, key, leaver.addr, time.Hour}},
+	} {
+		data := leaver.sealMessage(jsonCodec{}, req.action, requestDomain(req.action), uint64(50+i), target.id, req.msg)
+		for _, want := range []error{nil, ErrBadRequest} {
+			v, err := network.Post(context.Background(), target.addr, req.action, data)
+			if err != nil {
+				t.Fatalf("error while sending %s: %v", req.action, err)
+			}
+			if err := readResponse(req.action, v, &struct{}{}); !errors.Is(err, want) {
+				t.Fatalf("expected %v sending %s, got %v", want, req.action, err)
+			}
+		}
+	}
+
+	if count := target.expireSeen(time.Now().Add(2 * requestWindow)); count == 0 {
+		t.Fatalf("expected received requests to be forgotten once they can not be replayed")
+	}
+}
+
+func TestMixedCodecs(t *testing.T) {
+	count := 0
+	_, dhts, key := initTestValue(t, 20, func(d *SDHT) {
+		d.K = 3
+		if count%2 == 0 {
+			d.Codec = BinaryCodec
+		}
+		count++
+	})
+
+	for _, d := range dhts[1:3] {
+		checkTestValue(t, d, key)
+	}
+
+	// Values which are not valid UTF-8 are not corrupted by either codec.
+	value := []byte("\xff\x00\xc3")
+	key = marshalID(genID())
+	if err := dhts[0].StoreValue(context.Background(), key, value, 0); err != nil {
+		t.Fatalf("error while storing file in DHT: %v", err)
+	}
+	for _, d := range dhts[1:3] {
+		if data, err := d.FindValue(context.Background(), key); err != nil || !bytes.Equal(data, value) {
+			t.Fatalf("expected %q from DHT, got %q, %v", value, data, err)
+		}
+	}
+}
+
+// simAddrs returns the addresses of dhts.
+func simAddrs(dhts []*SDHT) []iface.Address {
+	addrs := []iface.Address{}
+	for _, d := range dhts {
+		addrs = append(addrs, d.addr)
+	}
+	return addrs
+}
+
+// initSimDHTs creates count SDHTs on a Sim of the given seed, running on its
+// clock over lossy links, each joining through an earlier node picked with r.
+// Found values are not cached, so that the holders of values stay the same.
+// configure is applied to every SDHT before it is initialized.
+func initSimDHTs(r *rand.Rand, seed int64, count int, configure func(*SDHT)) (*testnet.Sim, []*SDHT) {
+	sim := testnet.NewSim(seed)
+	sim.SetDefaultLink(testnet.Link{Latency: testnet.Uniform(time.Millisecond, 40*time.Millisecond), Loss: 0.02})
+	dhts := []*SDHT{}
+	for i := 0; i < count; i++ {
+		d := &SDHT{K: 3, RPCTimeout: 100 * time.Millisecond, CacheTTL: time.Nanosecond, Clock: sim.Clock()}
+		configure(d)
+		addr := iface.Address{IP: strconv.Itoa(i), Port: 0}
+		sim.Add(addr, d)
+		seeds := []iface.Address{}
+		if i != 0 {
+			seeds = append(seeds, iface.Address{IP: strconv.Itoa(r.Intn(i)), Port: 0})
+		}
+		d.Init(addr, seeds, sim.Net(addr))
+		dhts = append(dhts, d)
+	}
+	return sim, dhts
+}
+
+func TestSimulatedFaults(t *testing.T) {
+	r := newTestRand(t)
+	sim, dhts := initSimDHTs(r, 1, 30, func(*SDHT) {})
+	defer stopBackground(dhts)
+
+	// The key is drawn from r too, so that the holders are the same on every
+	// run.
+	id := ID{}
+	r.Read(id[:])
+	key := marshalID(id)
+	if err := dhts[0].StoreValue(context.Background(), key, []byte(dataToStore), 0); err != nil {
+		t.Fatalf("error while storing file in DHT: %v", err)
+	}
+	stored := holders(dhts, key)
+	if len(stored) < 2 {
+		t.Fatalf("expected the value to be stored at several nodes, got %d", len(stored))
+	}
+	// The querier is the last node which does not hold the value.
+	var querier *SDHT
+	for _, d := range dhts {
+		if len(holders([]*SDHT{d}, key)) == 0 {
+			querier = d
+		}
+	}
+	find := func() error {
+		data, err := querier.FindValue(context.Background(), key)
+		if err == nil && string(data) != dataToStore {
+			t.Fatalf("invalid data received from DHT, expected %q, got %q", dataToStore, data)
+		}
+		return err
+	}
+	if err := find(); err != nil {
+		t.Fatalf("error while fetching file despite message loss: %v", err)
+	}
+
+	// RPCs to the holders time out over slow links.
+	for _, h := range stored {
+		sim.SetLink(querier.addr, h.addr, testnet.Link{Latency: testnet.Constant(time.Second)})
+	}
+	if err := find(); err == nil {
+		t.Fatalf("expected the value to be unreachable over slow links")
+	}
+	for _, h := range stored {
+		sim.SetLink(querier.addr, h.addr, testnet.Link{})
+	}
+	if err := find(); err != nil {
+		t.Fatalf("error while fetching file once links are fast again: %v", err)
+	}
+
+	// The value is unreachable while its holders are partitioned off.
+	sim.Partition(0, time.Minute, simAddrs(stored)...)
+	if err := find(); err == nil {
+		t.Fatalf("expected the value to be unreachable during the partition")
+	}
+	sim.Advance(time.Minute)
+	if err := find(); err != nil {
+		t.Fatalf("error while fetching file after the partition healed: %v", err)
+	}
+
+	// The value is lost while all its holders are crashed, and found again
+	// once one of them restarts with its state.
+	for _, h := range stored {
+		sim.Crash(h.addr)
+	}
+	if err := find(); err == nil {
+		t.Fatalf("expected the value to be unreachable with all holders crashed")
+	}
+	sim.Restart(stored[0].addr, stored[0])
+	if err := find(); err != nil {
+		t.Fatalf("error while fetching file after a holder restarted: %v", err)
+	}
+}
+
+// simulateRepublish stores a value in SDHTs on a Sim of the given seed, lets
+// time pass while its publisher republishes it, then crashes the publisher,
+// and returns the trace of the Sim.
+func simulateRepublish(t *testing.T, seed int64) []string {
+	r := newTestRand(t)
+	sim, dhts := initSimDHTs(r, seed, 12, func(d *SDHT) {
+		d.RepublishInterval = time.Minute
+		d.RefreshInterval = 5 * time.Minute
+	})
+	defer stopBackground(dhts)
+
+	id := ID{}
+	r.Read(id[:])
+	key := marshalID(id)
+	if err := dhts[0].StoreValue(context.Background(), key, []byte(dataToStore), 0); err != nil {
+		t.Fatalf("error while storing file in DHT: %v", err)
+	}
+	// The value would expire after a minute without being republished.
+	sim.Advance(10 * time.Minute)
+	if len(holders(dhts, key)) == 0 {
+		t.Fatalf("expected the value to be republished")
+	}
+	sim.Crash(dhts[0].addr)
+	sim.Advance(10 * time.Minute)
+	if stored := holders(dhts[1:], key); len(stored) != 0 {
+		t.Fatalf("expected the value to expire once its publisher crashed, held by %d nodes", len(stored))
+	}
+	return sim.Trace()
+}
+
+func TestSimulatedRepublish(t *testing.T) {
+	simulateRepublish(t, 1)
+}
+
+func TestSimulatedRunsReproducible(t *testing.T) {
+	runs := [][]string{}
+	for _, seed := range []int64{1, 1, 2} {
+		runs = append(runs, simulateRepublish(t, seed))
+	}
+
+	first, second := strings.Join(runs[0], "\n"), strings.Join(runs[1], "\n")
+	if first != second {
+		for i := 0; i < len(runs[0]) && i < len(runs[1]); i++ {
+			if runs[0][i] != runs[1][i] {
+				t.Fatalf("expected runs with the same seed to be the same, first difference at event %d: %q and %q", i, runs[0][i], runs[1][i])
+			}
+		}
+		t.Fatalf("expected runs with the same seed to be the same, got %d and %d events", len(runs[0]), len(runs[1]))
+	}
+	if first == strings.Join(runs[2], "\n") {
+		t.Fatalf("expected runs with different seeds to differ")
+	}
+}
@@ -0,0 +1,145 @@
+package sdht
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sakshamsharma/sarga/common/iface"
+	"github.com/sakshamsharma/sarga/impl/slog"
+)
+
+// DefaultDiscoveryInterval is how often a node multicasts its beacon, used
+// when SDHT.DiscoveryInterval is not set.
+const DefaultDiscoveryInterval = 30 * time.Second
+
+const (
+	// beaconMagic starts every beacon, followed by the ID of the node and the
+	// port it serves the DHT on as a big endian uint16.
+	beaconMagic = "SRGA"
+	beaconSize  = len(beaconMagic) + len(ID{}) + 2
+)
+
+// marshalBeacon returns the beacon of the node with the given ID and port.
+func marshalBeacon(id ID, port int) []byte {
+	b := append([]byte(beaconMagic), id[:]...)
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// unmarshalBeacon returns the ID and port carried by a beacon.
+func unmarshalBeacon(b []byte) (ID, int, error) {
+	if len(b) != beaconSize || !bytes.HasPrefix(b, []byte(beaconMagic)) {
+		return ID{}, 0, fmt.Errorf("invalid beacon of length %d", len(b))
+	}
+	id := ID{}
+	copy(id[:], b[len(beaconMagic):])
+	return id, int(binary.BigEndian.Uint16(b[len(beaconMagic)+len(id):])), nil
+}
+
+// startDiscovery joins DiscoveryGroup, and starts the background tasks which
+// multicast the beacon of this node every DiscoveryInterval and add the nodes
+// whose beacons are heard.
+func (d *SDHT) startDiscovery() error {
+	group, err := net.ResolveUDPAddr("udp4", d.DiscoveryGroup.String())
+	if err != nil {
+		return err
+	}
+	var ifi *net.Interface
+	var from *net.UDPAddr
+	if d.DiscoveryInterface != "" {
+		if ifi, err = net.InterfaceByName(d.DiscoveryInterface); err != nil {
+			return err
+		}
+		// Multicasts are sent on the interface the sender is bound to.
+		if from, err = interfaceAddr(ifi); err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		return err
+	}
+	sender, err := net.DialUDP("udp4", from, group)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	d.background(func(context.Context) {
+		<-d.stop
+		listener.Close()
+		sender.Close()
+	})
+	d.background(func(context.Context) {
+		d.listenBeacons(listener)
+	})
+	beacon := marshalBeacon(d.id, d.addr.Port)
+	send := func(context.Context) {
+		if _, err := sender.Write(beacon); err != nil {
+			d.log.Println(slog.Debug, d.id, "could not send beacon:", err)
+		}
+	}
+	d.background(send)
+	d.every(d.DiscoveryInterval, send)
+	d.log.Println(slog.Debug, d.id, "discovering peers on", group)
+	return nil
+}
+
+// interfaceAddr returns the first IPv4 address of ifi.
+func interfaceAddr(ifi *net.Interface) (*net.UDPAddr, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return &net.UDPAddr{IP: ipNet.IP}, nil
+		}
+	}
+	return nil, fmt.Errorf("no IPv4 address on interface %s", ifi.Name)
+}
+
+// listenBeacons reads beacons from listener until it is closed, and adds the
+// nodes which sent them.
+func (d *SDHT) listenBeacons(listener *net.UDPConn) {
+	buf := make([]byte, beaconSize+1)
+	for {
+		n, src, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			d.log.Println(slog.Debug, d.id, "stopped listening for beacons:", err)
+			return
+		}
+		id, port, err := unmarshalBeacon(buf[:n])
+		if err != nil {
+			d.log.Println(slog.Verbose, d.id, "got an invalid beacon from", src, ":", err)
+			continue
+		}
+		if id == d.id || indexOf(d.buckets.all(), id) >= 0 {
+			continue
+		}
+		p := Peer{ID: id, Addr: iface.Address{IP: src.IP.String(), Port: port}}
+		d.background(func(ctx context.Context) {
+			d.discovered(ctx, p)
+		})
+	}
+}
+
+// discovered adds p, whose beacon was heard, to the routing table once it
+// answers a ping with the ID of the beacon. If p is the first peer known, this
+// node joins the network through it.
+func (d *SDHT) discovered(ctx context.Context, p Peer) {
+	alone := len(d.buckets.all()) == 0
+	if err := d.pingPeer(ctx, p); err != nil {
+		d.log.Println(slog.Debug, d.id, "could not reach discovered peer at", p.Addr, ":", err)
+		return
+	}
+	d.log.Println(slog.Debug, d.id, "discovered", p.ID, "at", p.Addr)
+	d.buckets.insert(d.id, p)
+	if alone {
+		d.findClosestPeers(ctx, marshalID(d.id), true)
+	}
+}
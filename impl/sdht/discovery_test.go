@@ -0,0 +1,63 @@
+package sdht
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sakshamsharma/sarga/common/iface"
+	"github.com/sakshamsharma/sarga/impl/testnet"
+)
+
+func TestBeacon(t *testing.T) {
+	id := genID()
+	got, port, err := unmarshalBeacon(marshalBeacon(id, 8080))
+	if err != nil {
+		t.Fatalf("error while reading beacon: %v", err)
+	}
+	if got != id || port != 8080 {
+		t.Fatalf("expected beacon of %v at port 8080, got %v at port %d", id, got, port)
+	}
+	if _, _, err := unmarshalBeacon([]byte("SRGA")); err == nil {
+		t.Fatalf("expected an error reading a truncated beacon")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	group := iface.Address{IP: "239.255.77.77", Port: 20000 + rand.Intn(10000)}
+	if conn, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP(group.IP), Port: group.Port}); err != nil {
+		t.Skipf("multicast is not available: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	// The nodes know of no seeds, and find each other over the loopback
+	// interface, where their beacons come from 127.0.0.1.
+	network := testnet.InitTestNet()
+	dhts := []*SDHT{}
+	for i := 0; i < 3; i++ {
+		d := &SDHT{
+			DiscoveryGroup:     group,
+			DiscoveryInterface: "lo",
+			DiscoveryInterval:  20 * time.Millisecond,
+		}
+		addr := iface.Address{IP: "127.0.0.1", Port: 1000 + i}
+		if err := d.Init(addr, nil, network); err != nil {
+			t.Skipf("could not start discovery: %v", err)
+		}
+		network.Add(addr, d)
+		dhts = append(dhts, d)
+	}
+	defer stopBackground(dhts)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, d := range dhts {
+		for len(d.buckets.all()) != len(dhts)-1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d discovered peers, got %v", len(dhts)-1, d.buckets.all())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
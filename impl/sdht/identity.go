@@ -0,0 +1,72 @@
+package sdht
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// identity is the on-disk representation of the identity of a node, which
+// lets it keep its ID across restarts.
+type identity struct {
+	// ID is derived from Key, and only kept for reference.
+	ID string
+	// Key is the ed25519 private key of the node.
+	Key []byte
+}
+
+// loadIdentity reads the node key from path. If the file does not exist, a new
+// key whose ID is valid for difficulty is generated and written to it.
+func loadIdentity(path string, difficulty int) (ed25519.PrivateKey, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return createIdentity(path, difficulty)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ident := identity{}
+	if err := json.Unmarshal(bytes, &ident); err != nil {
+		return nil, fmt.Errorf("invalid identity file %q: %v", path, err)
+	}
+	if len(ident.Key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf(
+			"invalid key in identity file %q, expected length %d, got: %d",
+			path, ed25519.PrivateKeySize, len(ident.Key))
+	}
+	key := ed25519.PrivateKey(ident.Key)
+	id := idFromKey(key.Public().(ed25519.PublicKey))
+	if marshalID(id) != ident.ID {
+		return nil, fmt.Errorf(
+			"ID in identity file %q does not match its key, expected %s, got: %s",
+			path, marshalID(id), ident.ID)
+	}
+	if !validID(id, difficulty) {
+		return nil, fmt.Errorf(
+			"ID in identity file %q does not meet difficulty %d", path, difficulty)
+	}
+	return key, nil
+}
+
+// createIdentity generates a new key whose ID is valid for difficulty, and
+// writes it to path.
+func createIdentity(path string, difficulty int) (ed25519.PrivateKey, error) {
+	key, err := generateKey(difficulty)
+	if err != nil {
+		return nil, err
+	}
+	id := idFromKey(key.Public().(ed25519.PublicKey))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	bytes := marshal(identity{ID: marshalID(id), Key: key})
+	if err := ioutil.WriteFile(path, bytes, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
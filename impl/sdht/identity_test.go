@@ -0,0 +1,35 @@
+package sdht
+
+import (
+	"crypto/ed25519"
+	"crypto/sha1"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "identity.json")
+
+	key, err := loadIdentity(path, 4)
+	if err != nil {
+		t.Fatalf("error while creating identity: %v", err)
+	}
+	id := idFromKey(key.Public().(ed25519.PublicKey))
+	if !validID(id, 4) {
+		t.Fatalf("expected created ID %v to meet difficulty 4", id)
+	}
+
+	loadedKey, err := loadIdentity(path, 4)
+	if err != nil {
+		t.Fatalf("error while loading identity: %v", err)
+	}
+	if !loadedKey.Equal(key) {
+		t.Fatalf("expected the same key to be loaded")
+	}
+
+	// The network now requires more work than went into the saved ID.
+	difficulty := distance(sha1.Sum(id[:])).prefixLen() + 1
+	if _, err := loadIdentity(path, difficulty); err == nil {
+		t.Fatalf("expected an error loading an ID which does not meet difficulty %d", difficulty)
+	}
+}
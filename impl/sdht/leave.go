@@ -0,0 +1,87 @@
+package sdht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sakshamsharma/sarga/common/iface"
+	"github.com/sakshamsharma/sarga/impl/slog"
+)
+
+// DefaultLeaveTimeout bounds how long Shutdown waits for a graceful leave, used
+// when SDHT.LeaveTimeout is not set.
+const DefaultLeaveTimeout = 10 * time.Second
+
+// leave hands off every stored key and provider record to the next closest
+// live nodes, and then announces the exit to every peer of the routing table.
+// It gives up after LeaveTimeout.
+func (d *SDHT) leave() {
+	ctx, cancel := iface.WithTimeout(context.Background(), d.Clock, d.LeaveTimeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.handOff(ctx)
+		// Peers must not hear from this node after its exit, so no lookup is
+		// started from now on, such as for find_value requests.
+		d.stopLock.Lock()
+		d.exiting = true
+		d.stopLock.Unlock()
+		d.inflight.Wait()
+		d.announceExit(ctx)
+	}()
+
+	select {
+	case <-done:
+		d.log.Println(slog.Debug, d.id, "left the network")
+	case <-ctx.Done():
+		d.log.Println(slog.Error, d.id, "timed out while leaving the network")
+	}
+}
+
+// handOff sends every value and provider record held by this node to the k
+// closest other nodes. Provider records keep the time they expire at.
+func (d *SDHT) handOff(ctx context.Context) {
+	for key, rec := range d.store.Snapshot() {
+		if rec.Cached {
+			continue
+		}
+		keyID, _ := unmarshalID(key)
+		d.log.Println(slog.VVerbose, d.id, "handing off key", keyID)
+		if err := d.storeAtClosest(ctx, key, rec, false); err != nil {
+			d.log.Println(slog.Debug, d.id, "could not hand off key", keyID, ":", err)
+		}
+	}
+
+	now := d.Clock.Now()
+	for key, addrs := range d.providers.snapshot(now) {
+		keyID, _ := unmarshalID(key)
+		for addr, expires := range addrs {
+			d.log.Println(slog.VVerbose, d.id, "handing off provider", addr, "of key", keyID)
+			err := d.sendToClosest(ctx, key, "hand off provider", nil, func(p Peer) error {
+				return p.AddProvider(ctx, d, key, addr, expires.Sub(now))
+			})
+			if err != nil {
+				d.log.Println(slog.Debug, d.id, "could not hand off provider of key", keyID, ":", err)
+			}
+		}
+	}
+}
+
+// announceExit sends exit to every peer of the routing table in parallel, and
+// waits for all of them to acknowledge or fail.
+func (d *SDHT) announceExit(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range d.buckets.all() {
+		wg.Add(1)
+		go func(p Peer) {
+			defer wg.Done()
+			if err := p.AnnounceExit(ctx, d); err != nil {
+				d.log.Println(slog.Debug, d.id, "could not announce exit to", p.ID, ":", err)
+			}
+		}(p)
+	}
+	wg.Wait()
+}
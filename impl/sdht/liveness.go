@@ -0,0 +1,107 @@
+package sdht
+
+import (
+	"context"
+	"time"
+
+	"github.com/sakshamsharma/sarga/impl/slog"
+)
+
+const (
+	// DefaultMaxFailures is the number of consecutive failed RPCs after which
+	// a peer is evicted, used when SDHT.MaxFailures is not set.
+	DefaultMaxFailures = 3
+	// DefaultStaleTimeout is how long a peer can go unseen before it is pinged,
+	// and evicted if it does not answer, used when SDHT.StaleTimeout is not
+	// set.
+	DefaultStaleTimeout = 15 * time.Minute
+)
+
+// liveness tracks how a peer has been answering.
+type liveness struct {
+	LastSeen time.Time
+	// Failures is the number of consecutive RPCs to the peer which failed.
+	Failures int
+}
+
+// setAliveTime records that the peer id was just seen alive. Only the peers of
+// the routing table are tracked, so that requesters can not grow alive with
+// made up IDs.
+func (d *SDHT) setAliveTime(id ID) {
+	if !d.buckets.contains(d.id, id) {
+		return
+	}
+	d.aliveLock.Lock()
+	defer d.aliveLock.Unlock()
+
+	d.alive[id] = liveness{LastSeen: d.Clock.Now()}
+}
+
+// setFailed records that an RPC to peer failed, and evicts it from the
+// routing table after MaxFailures consecutive failures. Peers not in the
+// routing table are not tracked.
+func (d *SDHT) setFailed(peer Peer) {
+	if !d.buckets.contains(d.id, peer.ID) {
+		return
+	}
+	d.aliveLock.Lock()
+	l := d.alive[peer.ID]
+	l.Failures++
+	d.alive[peer.ID] = l
+	d.aliveLock.Unlock()
+
+	if l.Failures >= d.MaxFailures {
+		d.log.Println(slog.Debug, d.id, "evicting", peer.ID, "after", l.Failures, "failed RPCs")
+		d.evict(peer.ID)
+	}
+}
+
+// evict removes id from the routing table, promoting a replacement if any.
+func (d *SDHT) evict(id ID) {
+	d.forget(id)
+	d.buckets.replace(d.id, id)
+}
+
+// forget stops tracking the liveness of id, once it left the routing table.
+func (d *SDHT) forget(id ID) {
+	d.aliveLock.Lock()
+	defer d.aliveLock.Unlock()
+
+	delete(d.alive, id)
+}
+
+// evictStale pings every peer of the routing table not seen for StaleTimeout,
+// and evicts those which do not answer.
+func (d *SDHT) evictStale(ctx context.Context) {
+	now := d.Clock.Now()
+	for _, p := range d.buckets.all() {
+		d.aliveLock.Lock()
+		l, ok := d.alive[p.ID]
+		if !ok {
+			// Peers learnt from others are given a full timeout from now on.
+			d.alive[p.ID] = liveness{LastSeen: now}
+		}
+		d.aliveLock.Unlock()
+
+		if !ok || now.Sub(l.LastSeen) < d.StaleTimeout {
+			continue
+		}
+		if err := d.pingPeer(ctx, p); err != nil {
+			d.log.Println(slog.Debug, d.id, "evicting stale peer", p.ID, ":", err)
+			d.evict(p.ID)
+		}
+	}
+}
+
+// livenessInfo returns the liveness of all the tracked peers, keyed by their
+// marshalled IDs.
+func (d *SDHT) livenessInfo() string {
+	d.aliveLock.Lock()
+	defer d.aliveLock.Unlock()
+
+	tmpMap := map[string]liveness{}
+	for id, l := range d.alive {
+		tmpMap[marshalID(id)] = l
+	}
+	return string(marshal(tmpMap))
+}
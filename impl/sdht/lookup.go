@@ -0,0 +1,347 @@
+package sdht
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/sakshamsharma/sarga/impl/slog"
+)
+
+const (
+	// DefaultAlpha is the number of RPCs a lookup keeps in flight, used when
+	// SDHT.Alpha is not set.
+	DefaultAlpha = 3
+	// DefaultPaths is the number of disjoint paths a lookup follows, used
+	// when SDHT.Paths is not set.
+	DefaultPaths = 1
+)
+
+// lookupMode is what a lookup asks peers for.
+type lookupMode int
+
+const (
+	// findNodes asks peers for the nodes closest to the key only.
+	findNodes lookupMode = iota
+	// findFirstValue asks peers for the value, and stops at the first peer
+	// which returns it.
+	findFirstValue
+	// findAllValues asks peers for the value, and keeps going until the k
+	// closest peers answered, collecting every value returned on the way.
+	findAllValues
+)
+
+type lookupState int
+
+const (
+	uncontacted lookupState = iota
+	inFlight
+	answered
+	failed
+)
+
+// lookupReply is the outcome of a single RPC sent during a lookup.
+type lookupReply struct {
+	peer  Peer
+	data  []byte
+	peers []Peer
+	err   error
+}
+
+// lookupResult is the outcome of an iterative lookup.
+type lookupResult struct {
+	// data is set if a value lookup found the key, holder being the peer that
+	// returned it.
+	data   []byte
+	holder Peer
+	// cache is the closest peer which answered the value lookup without the
+	// value, if any, and between the number of nodes closer to the key than it
+	// which answered without the value, this node included.
+	cache   *Peer
+	between int
+	// closest holds up to k peers closest to the key which answered, closest
+	// first.
+	closest []Peer
+	// values holds every value returned to a findAllValues lookup.
+	values [][]byte
+	// lastErr is the error of the last peer which failed, if any.
+	lastErr error
+}
+
+// lookup runs an iterative Kademlia lookup for key. Unless mode is findNodes,
+// peers are asked for the value: findFirstValue stops as soon as one of them
+// returns it, while findAllValues goes on until the k closest peers answered
+// and collects every value returned on the way. If insert is set, every peer
+// which answers is added to the routing table; peers which are only mentioned
+// in answers are not, since any ID can be mentioned at any address. The lookup
+// gives up with the error of ctx once it is done.
+//
+// If d.Paths is more than 1, the closest peers of the routing table are split
+// among that many lookups run in parallel, which never contact the same peer.
+// As long as one of the paths only goes through honest peers, a malicious peer
+// can not keep the lookup from reaching the closest peers to the key.
+func (d *SDHT) lookup(ctx context.Context, key string, mode lookupMode, insert bool) (lookupResult, error) {
+	if !d.startLookup() {
+		return lookupResult{}, errExiting
+	}
+	// The RPCs of the lookup are added to inflight while it is held, so that
+	// they never race with leave waiting on it.
+	defer d.inflight.Done()
+
+	keyID, _ := unmarshalID(key)
+	d.buckets.touch(d.id, keyID, d.Clock.Now())
+	seeds, err := d.findNode(key)
+	if err != nil {
+		return lookupResult{}, err
+	}
+	if d.Paths <= 1 {
+		return d.lookupPath(ctx, key, seeds, mode, insert, nil)
+	}
+
+	// claimed holds the peers already part of a path.
+	claimed := map[ID]bool{}
+	var claimedLock sync.Mutex
+	claim := func(id ID) bool {
+		claimedLock.Lock()
+		defer claimedLock.Unlock()
+
+		if claimed[id] {
+			return false
+		}
+		claimed[id] = true
+		return true
+	}
+
+	results := make([]lookupResult, d.Paths)
+	errs := make([]error, d.Paths)
+	var wg sync.WaitGroup
+	for i := 0; i < d.Paths; i++ {
+		pathSeeds := []Peer{}
+		for j := i; j < len(seeds); j += d.Paths {
+			pathSeeds = append(pathSeeds, seeds[j])
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = d.lookupPath(ctx, key, pathSeeds, mode, insert, claim)
+		}(i)
+	}
+	wg.Wait()
+	return mergeResults(keyID, d.K, results, errs)
+}
+
+// errExiting is returned by lookups started after this node announced its
+// exit.
+var errExiting = errors.New("node is leaving the network")
+
+// startLookup adds a lookup to inflight, unless this node is announcing its
+// exit.
+func (d *SDHT) startLookup() bool {
+	d.stopLock.Lock()
+	defer d.stopLock.Unlock()
+
+	if d.exiting {
+		return false
+	}
+	d.inflight.Add(1)
+	return true
+}
+
+// mergeResults merges the results of the disjoint paths of a lookup for key.
+// The value is taken from the first path which found it, and the k closest
+// peers out of all paths are kept. An error is returned only if every path
+// failed.
+func mergeResults(key ID, k int, results []lookupResult, errs []error) (lookupResult, error) {
+	merged := lookupResult{}
+	var err error
+	succeeded := false
+	for i, result := range results {
+		if errs[i] != nil {
+			err = errs[i]
+			continue
+		}
+		succeeded = true
+		if result.data != nil && merged.data == nil {
+			merged.data = result.data
+			merged.holder = result.holder
+			merged.cache = result.cache
+			merged.between = result.between
+		}
+		for _, p := range result.closest {
+			// Only this node itself can be part of several paths.
+			if indexOf(merged.closest, p.ID) < 0 {
+				merged.closest = append(merged.closest, p)
+			}
+		}
+		merged.values = append(merged.values, result.values...)
+		if result.lastErr != nil {
+			merged.lastErr = result.lastErr
+		}
+	}
+	if !succeeded {
+		return lookupResult{}, err
+	}
+
+	sort.Slice(merged.closest, func(i, j int) bool {
+		return isBetter(key, merged.closest[i], merged.closest[j])
+	})
+	merged.closest = merged.closest[:min(len(merged.closest), k)]
+	return merged, nil
+}
+
+// lookupPath runs a single lookup path starting from seeds, keeping up to
+// d.Alpha RPCs in flight. It maintains a shortlist of contacted and
+// uncontacted peers, and stops once the k closest peers it knows of have all
+// answered. If claim is set, peers are only added to the shortlist if claim
+// returns true for them, which it does once per peer across all paths.
+func (d *SDHT) lookupPath(ctx context.Context, key string, seeds []Peer, mode lookupMode, insert bool, claim func(ID) bool) (lookupResult, error) {
+	keyID, _ := unmarshalID(key)
+	result := lookupResult{}
+	shortlist := []Peer{}
+	states := map[ID]lookupState{}
+	add := func(p Peer) {
+		if _, ok := states[p.ID]; ok {
+			return
+		}
+		if !validID(p.ID, d.Difficulty) {
+			// Such a peer would never make it to a routing table.
+			return
+		}
+		if p.ID == d.id {
+			// Our own routing table was consulted when seeding the shortlist.
+			states[p.ID] = answered
+		} else if claim != nil && !claim(p.ID) {
+			// The peer is part of another path.
+			return
+		} else {
+			states[p.ID] = uncontacted
+		}
+		shortlist = append(shortlist, p)
+	}
+	for _, p := range seeds {
+		add(p)
+	}
+
+	replies := make(chan lookupReply, d.Alpha)
+	pending := 0
+	query := func(p Peer) {
+		defer d.inflight.Done()
+		if mode != findNodes {
+			data, peers, err := p.FindValue(ctx, d, key)
+			replies <- lookupReply{p, data, peers, err}
+		} else {
+			peers, err := p.FindNode(ctx, d, key)
+			replies <- lookupReply{p, nil, peers, err}
+		}
+	}
+
+	for {
+		sort.Slice(shortlist, func(i, j int) bool {
+			return isBetter(keyID, shortlist[i], shortlist[j])
+		})
+
+		// Only the k closest peers which have not failed are of interest.
+		done := true
+		seen := 0
+		for _, p := range shortlist {
+			if seen == d.K {
+				break
+			}
+			switch states[p.ID] {
+			case failed:
+				continue
+			case uncontacted:
+				done = false
+				if pending < d.Alpha {
+					states[p.ID] = inFlight
+					pending++
+					d.inflight.Add(1)
+					go query(p)
+				}
+			case inFlight:
+				done = false
+			}
+			seen++
+		}
+		if done {
+			drain(replies, pending)
+			break
+		}
+
+		var reply lookupReply
+		select {
+		case reply = <-replies:
+		case <-ctx.Done():
+			drain(replies, pending)
+			return lookupResult{}, ctx.Err()
+		}
+		pending--
+		if reply.err != nil && ctx.Err() != nil {
+			// The peer is not to blame for the lookup being cancelled.
+			drain(replies, pending)
+			return lookupResult{}, ctx.Err()
+		}
+		if reply.err != nil {
+			d.log.Println(slog.Verbose, d.id, "got an error contacting peer", reply.peer.ID, "during lookup:", reply.err)
+			states[reply.peer.ID] = failed
+			d.setFailed(reply.peer)
+			result.lastErr = reply.err
+			continue
+		}
+		states[reply.peer.ID] = answered
+		if insert {
+			// The response was signed with the key of the peer, which proves
+			// its ID is reachable at its address.
+			d.buckets.insert(d.id, reply.peer)
+		}
+		d.setAliveTime(reply.peer.ID)
+
+		if reply.data != nil && mode == findAllValues {
+			result.values = append(result.values, reply.data)
+		} else if reply.data != nil {
+			drain(replies, pending)
+			result.data, result.holder = reply.data, reply.peer
+			sort.Slice(shortlist, func(i, j int) bool {
+				return isBetter(keyID, shortlist[i], shortlist[j])
+			})
+			// Peers which were not contacted, or did not answer yet, are not
+			// known to lack the value, so they are not counted as between.
+			for _, p := range shortlist {
+				if states[p.ID] != answered || p.ID == reply.peer.ID {
+					continue
+				}
+				if p.ID != d.id {
+					p := p
+					result.cache = &p
+					break
+				}
+				result.between++
+			}
+			return result, nil
+		}
+
+		for _, p := range reply.peers {
+			add(p)
+		}
+	}
+
+	for _, p := range shortlist {
+		if len(result.closest) == d.K {
+			break
+		}
+		if states[p.ID] == answered {
+			result.closest = append(result.closest, p)
+		}
+	}
+	return result, nil
+}
+
+// drain lets the n RPCs still in flight finish without blocking on them.
+func drain(replies chan lookupReply, n int) {
+	go func() {
+		for i := 0; i < n; i++ {
+			<-replies
+		}
+	}()
+}
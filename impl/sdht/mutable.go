@@ -0,0 +1,90 @@
+package sdht
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sakshamsharma/sarga/common/dht"
+	"github.com/sakshamsharma/sarga/impl/slog"
+)
+
+// StoreMutable stores rec at the k nodes closest to its key like StoreValue.
+// Nodes holding a version with a higher sequence number, or another version
+// with the same one, keep it instead. If none of them stored rec, the error
+// wraps ErrConflict.
+func (d *SDHT) StoreMutable(ctx context.Context, rec dht.MutableRecord, ttl time.Duration) error {
+	if err := rec.Verify(); err != nil {
+		return err
+	}
+	key := rec.Key()
+	keyID, _ := unmarshalID(key)
+	d.log.Println(slog.Verbose, d.id, "Sending StoreMutable", keyID, "version", rec.Seq)
+
+	d.publishedLock.Lock()
+	old, ok := d.published[key]
+	d.publishedLock.Unlock()
+	if ok && old.Mutable && old.Seq > rec.Seq {
+		return fmt.Errorf("%w: a newer version %d of mutable record %v was published", ErrConflict, old.Seq, keyID)
+	}
+
+	if ttl <= 0 {
+		ttl = d.defaultTTL()
+	}
+	return d.publish(ctx, key, record{
+		Data:      rec.Marshal(),
+		Published: d.Clock.Now(),
+		TTL:       ttl,
+		Mutable:   true,
+		Seq:       rec.Seq,
+	})
+}
+
+// FindMutable runs a value lookup for key which, unlike FindValue, does not
+// stop at the first node holding a version, since that version may be
+// outdated. It goes on until the k closest nodes answered, and returns the
+// version with the highest sequence number which is signed by its publisher.
+// The error wraps ErrNotFound only if nodes answered without a version, so
+// that callers can tell a record which was never published from one they could
+// not reach.
+func (d *SDHT) FindMutable(ctx context.Context, key string) (dht.MutableRecord, error) {
+	keyID, _ := unmarshalID(key)
+	d.log.Println(slog.Verbose, d.id, "wants mutable key", keyID)
+	result, err := d.lookup(ctx, key, findAllValues, false)
+	if err != nil {
+		return dht.MutableRecord{}, err
+	}
+
+	newest := dht.MutableRecord{}
+	found := false
+	consider := func(data []byte) {
+		rec, err := dht.UnmarshalMutableRecord(key, data)
+		if err != nil {
+			d.log.Println(slog.Debug, d.id, "got an invalid mutable record for key", keyID, ":", err)
+			return
+		}
+		if !found || rec.Seq > newest.Seq {
+			newest, found = rec, true
+		}
+	}
+
+	if data, err := d.store.Get(key); err == nil {
+		consider(data)
+	}
+	for _, data := range result.values {
+		consider(data)
+	}
+	answered := len(result.values) > 0
+	for _, p := range result.closest {
+		if p.ID != d.id {
+			answered = true
+		}
+	}
+	if !found && !answered && result.lastErr != nil {
+		return dht.MutableRecord{}, fmt.Errorf("could not reach any node for the mutable record %v: %v", keyID, result.lastErr)
+	}
+	if !found {
+		return dht.MutableRecord{}, fmt.Errorf("did not find the mutable record %v: %w", keyID, ErrNotFound)
+	}
+	return newest, nil
+}
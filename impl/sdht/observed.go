@@ -0,0 +1,82 @@
+package sdht
+
+import (
+	"github.com/sakshamsharma/sarga/common/iface"
+	"github.com/sakshamsharma/sarga/impl/slog"
+)
+
+const (
+	// DefaultObservedQuorum is the number of peers which must report the same
+	// address for a node to advertise it, used when SDHT.ObservedQuorum is not
+	// set.
+	DefaultObservedQuorum = 3
+
+	// maxObservations bounds the number of peers whose reports are kept.
+	maxObservations = 64
+)
+
+// observe records that the peer with the given ID saw a request of this node
+// come from addr. Only the IP is kept, since requests are not sent from the
+// port this node listens on. Once ObservedQuorum peers agree on an IP, and
+// more of them report it than any other, this node advertises that IP with its
+// own port.
+func (d *SDHT) observe(id ID, addr iface.Address) {
+	if addr.IP == "" {
+		// The peer could not tell, or is too old to report it.
+		return
+	}
+
+	d.observedLock.Lock()
+	defer d.observedLock.Unlock()
+
+	if _, ok := d.observed[id]; !ok && len(d.observed) >= maxObservations {
+		// Make room by forgetting an arbitrary report.
+		for other := range d.observed {
+			delete(d.observed, other)
+			break
+		}
+	}
+	d.observed[id] = addr.IP
+
+	votes := map[string]int{}
+	best := ""
+	for _, ip := range d.observed {
+		votes[ip]++
+		if votes[ip] > votes[best] {
+			best = ip
+		}
+	}
+	for ip, count := range votes {
+		if ip != best && count == votes[best] {
+			// No IP is reported more than the others.
+			return
+		}
+	}
+	if votes[best] < d.ObservedQuorum || best == d.external.IP {
+		return
+	}
+	d.external = iface.Address{IP: best, Port: d.addr.Port}
+	d.log.Println(slog.Debug, d.id, "is reachable at", d.external)
+}
+
+// ExternalIP returns the IP peers agree they reach this node at, or "" until
+// ObservedQuorum of them do.
+func (d *SDHT) ExternalIP() string {
+	d.observedLock.Lock()
+	defer d.observedLock.Unlock()
+
+	return d.external.IP
+}
+
+// advertisedAddr returns the address other nodes can reach this node at. It is
+// the address reported by its peers once they agree on one, and the address
+// it listens on until then.
+func (d *SDHT) advertisedAddr() iface.Address {
+	d.observedLock.Lock()
+	defer d.observedLock.Unlock()
+
+	if d.external.IP != "" {
+		return d.external
+	}
+	return d.addr
+}
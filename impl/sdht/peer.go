@@ -1,92 +1,137 @@
 package sdht
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/sakshamsharma/sarga/common/iface"
 )
 
-// Peer wraps interactions with the peers of a DHT.
+// DefaultRPCTimeout bounds how long an RPC to a peer can take, used when
+// SDHT.RPCTimeout is not set.
+const DefaultRPCTimeout = 10 * time.Second
+
+// Peer wraps interactions with the peers of a DHT. RPCs are sent over the
+// network of the SDHT which owns the peer, signed with its key. Responses must
+// be signed by the peer.
 type Peer struct {
 	ID   ID
 	Addr iface.Address
 }
 
-func (p *Peer) Ping() error {
-	resp, err := network.Get(p.Addr, "ping")
+// Ping checks that the peer is reachable, and fills in its ID from the key it
+// signed the response with.
+func (p *Peer) Ping(ctx context.Context, d *SDHT) error {
+	ctx, cancel := iface.WithTimeout(ctx, d.Clock, d.RPCTimeout)
+	defer cancel()
+	resp, err := d.net.Get(ctx, p.Addr, "ping")
 	if err != nil {
 		return fmt.Errorf("network error: %v", err)
 	}
+	msg, sender, err := openMessage("ping", responseDomain("ping"), resp)
+	if err != nil {
+		return fmt.Errorf("invalid response to ping: %v", err)
+	}
 	ret := pingResp{}
-	if err := json.Unmarshal(resp, &ret); err != nil {
-		return fmt.Errorf("error while unmarshalling JSON: %v", err)
+	if err := openResponse(msg, &ret); err != nil {
+		return err
+	}
+	if sender != ret.ID {
+		return fmt.Errorf("ping response claims to be from %v but is signed by %v", ret.ID, sender)
 	}
 
 	p.ID = ret.ID
+	d.observe(p.ID, ret.Observed)
 	return nil
 }
 
-func (p *Peer) SendStore(id ID, key string, data []byte) error {
-	// TODO: Validate key
-	keyValue := storeReq{id, key, string(data)}
-	bytes, err := json.Marshal(keyValue)
+// call sends req to the peer for action, and unmarshals the body of the
+// response into ret. If the peer answered with an error status, the error
+// wraps the matching sentinel error, such as ErrNotFound. The RPC gives up
+// after d.RPCTimeout, or once ctx is done.
+func (p *Peer) call(ctx context.Context, d *SDHT, action string, req, ret interface{}) error {
+	ctx, cancel := iface.WithTimeout(ctx, d.Clock, d.RPCTimeout)
+	defer cancel()
+	requestID := d.nextRequestID()
+	resp, err := d.net.Post(ctx, p.Addr, action,
+		d.sealMessage(d.codec(), action, requestDomain(action), requestID, p.ID, req))
 	if err != nil {
 		return err
 	}
-	// TODO: Errors will be ignored. Handle errors for PUT.
-	return network.Put(p.Addr, "store", bytes)
-}
-
-// TODO(pallavag): Make all calls async.
-func (p *Peer) FindNode(asker Peer, key string) ([]Peer, error) {
-	req := findNodeReq{asker, key}
-	bytes, err := json.Marshal(req)
+	msg, sender, err := openMessage(action, responseDomain(action), resp)
+	if err == nil && sender != p.ID {
+		err = fmt.Errorf("message claims to be from %v but is signed by %v", p.ID, sender)
+	}
+	if err == nil && msg.RequestID != requestID {
+		err = fmt.Errorf("response to request %d sent for request %d", msg.RequestID, requestID)
+	}
+	if err == nil && msg.Recipient != d.id {
+		err = fmt.Errorf("response sent to %v", msg.Recipient)
+	}
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("invalid response to %s: %v", action, err)
 	}
+	return openResponse(msg, ret)
+}
 
-	resp, err := network.Post(p.Addr, "find_node", bytes)
-	if err != nil {
-		return nil, err
+// openResponse unmarshals the body of the response held by msg into ret, or
+// returns the error it carries.
+func openResponse(msg message, ret interface{}) error {
+	r := response{}
+	if err := msg.codec.decode(msg.Body, &r); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
 	}
-	ret := findNodeResp{}
-	if err := json.Unmarshal(resp, &ret); err != nil {
-		return nil, err
+	if err := r.err(); err != nil {
+		return err
 	}
-	if ret.Error != nil {
-		return nil, ret.Error
+	if err := msg.codec.decode(r.Body, ret); err != nil {
+		return fmt.Errorf("invalid response body: %v", err)
 	}
-	return ret.Peers, nil
+	return nil
 }
 
-func (p *Peer) FindValue(id ID, key string) ([]byte, []Peer, error) {
-	req := findValueReq{id, key}
-	bytes, err := json.Marshal(req)
-	if err != nil {
-		return nil, nil, err
-	}
+// SendStore asks the peer to store rec under key.
+func (p *Peer) SendStore(ctx context.Context, d *SDHT, key string, rec record) error {
+	// TODO: Validate key
+	req := storeReq{d.id, key, rec.Data, rec.Published, rec.TTL, rec.Cached, rec.Mutable}
+	return p.call(ctx, d, "store", req, &storeResp{})
+}
 
-	resp, err := network.Post(p.Addr, "find_value_local", bytes)
-	if err != nil {
-		return nil, nil, err
+func (p *Peer) FindNode(ctx context.Context, d *SDHT, key string) ([]Peer, error) {
+	ret := findNodeResp{}
+	if err := p.call(ctx, d, "find_node", findNodeReq{d.getPeer(), key}, &ret); err != nil {
+		return nil, err
 	}
+	d.observe(p.ID, ret.Observed)
+	return ret.Peers, nil
+}
 
+func (p *Peer) FindValue(ctx context.Context, d *SDHT, key string) ([]byte, []Peer, error) {
 	ret := findValueResp{}
-	if err := json.Unmarshal(resp, &ret); err != nil {
+	if err := p.call(ctx, d, "find_value_local", findValueReq{d.id, key}, &ret); err != nil {
 		return nil, nil, err
 	}
-	if ret.Error != nil {
-		return nil, nil, ret.Error
-	}
 	return ret.Data, ret.Peers, nil
 }
 
-func (p *Peer) AnnounceExit() error {
-	req := exitReq{p.ID}
-	bytes, err := json.Marshal(req)
-	if err != nil {
-		return err
+// AddProvider tells the peer that the node at addr provides key, until ttl
+// from now.
+func (p *Peer) AddProvider(ctx context.Context, d *SDHT, key string, addr iface.Address, ttl time.Duration) error {
+	return p.call(ctx, d, "add_provider", addProviderReq{d.id, key, addr, ttl}, &addProviderResp{})
+}
+
+// GetProviders asks the peer for the providers of key it knows of.
+func (p *Peer) GetProviders(ctx context.Context, d *SDHT, key string) ([]iface.Address, error) {
+	ret := getProvidersResp{}
+	if err := p.call(ctx, d, "get_providers", getProvidersReq{d.id, key}, &ret); err != nil {
+		return nil, err
 	}
-	return network.Put(p.Addr, "exit", bytes)
+	return ret.Providers, nil
+}
+
+// AnnounceExit tells the peer that d is leaving the network, and waits for it
+// to acknowledge.
+func (p *Peer) AnnounceExit(ctx context.Context, d *SDHT) error {
+	return p.call(ctx, d, "exit", exitReq{d.id}, &exitResp{})
 }
@@ -0,0 +1,144 @@
+package sdht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ProtocolVersion is the version of the wire protocol spoken by this
+	// implementation. Every request and response is a message carrying the
+	// type of the message, a request ID, its sender and recipient, and the
+	// time it was sent, so that requests can not be replayed to another node
+	// or later on. Messages of any other version are rejected.
+	ProtocolVersion = 3
+
+	// requestWindow is how long after it was sent a request is accepted, and
+	// how far in the future its send time can be, to allow for the clocks of
+	// nodes to differ.
+	requestWindow = time.Minute
+)
+
+// message is the body of the signed envelope of every request and response.
+type message struct {
+	Version int
+	// Type is the RPC the message belongs to, such as "find_node".
+	Type string
+	// RequestID is chosen by the sender of a request, and repeated in the
+	// response to it.
+	RequestID uint64
+	Sender    ID
+	// Recipient is the node the message is sent to, or the zero ID for
+	// responses to requests of unknown senders.
+	Recipient ID
+	// Sent is when the message was sent.
+	Sent time.Time
+	Body json.RawMessage
+
+	// codec is the codec the message was received with, which its body is
+	// encoded with too.
+	codec codec
+}
+
+// sealMessage wraps msg in a message, encodes it with c, and signs it for
+// domain.
+func (d *SDHT) sealMessage(c codec, action, domain string, requestID uint64, recipient ID, msg interface{}) []byte {
+	return d.seal(c, domain, message{
+		Version:   ProtocolVersion,
+		Type:      action,
+		RequestID: requestID,
+		Sender:    d.id,
+		Recipient: recipient,
+		Sent:      d.Clock.Now(),
+		Body:      c.encode(msg),
+	})
+}
+
+// openMessage verifies that data is an envelope correctly signed for domain,
+// and returns the message it holds along with the ID of its signer.
+func openMessage(action, domain string, data []byte) (message, ID, error) {
+	body, signer, c, err := openEnvelope(domain, data)
+	if err != nil {
+		return message{}, ID{}, err
+	}
+
+	msg := message{}
+	if err := c.decode(body, &msg); err != nil {
+		return message{}, ID{}, fmt.Errorf("invalid message: %v", err)
+	}
+	msg.codec = c
+	switch {
+	case msg.Version != ProtocolVersion:
+		return message{}, ID{}, fmt.Errorf(
+			"unsupported protocol version %d, expected %d", msg.Version, ProtocolVersion)
+	case msg.Type != action:
+		return message{}, ID{}, fmt.Errorf("message of type %q sent for %q", msg.Type, action)
+	case msg.Sender != signer:
+		return message{}, ID{}, fmt.Errorf("message claims to be from %v but is signed by %v", msg.Sender, signer)
+	}
+	return msg, signer, nil
+}
+
+// nextRequestID returns a request ID not used before by this node.
+func (d *SDHT) nextRequestID() uint64 {
+	return atomic.AddUint64(&d.requestID, 1)
+}
+
+// firstRequestID returns a random request ID to count from, so that a node
+// which restarts with the same identity does not reuse the request IDs its
+// peers have seen.
+func firstRequestID() uint64 {
+	b := [8]byte{}
+	rand.Read(b[:])
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// seenRequest identifies a request by its sender and request ID.
+type seenRequest struct {
+	sender    ID
+	requestID uint64
+}
+
+// checkRequest returns an error if msg, a request received by this node, may
+// be a replay: if it was sent to another node, outside of requestWindow, or
+// was already received.
+func (d *SDHT) checkRequest(msg message) error {
+	if msg.Recipient != d.id {
+		return fmt.Errorf("request sent to %v", msg.Recipient)
+	}
+	now := d.Clock.Now()
+	if msg.Sent.Before(now.Add(-requestWindow)) || msg.Sent.After(now.Add(requestWindow)) {
+		return fmt.Errorf("request sent at %v is stale", msg.Sent)
+	}
+
+	d.seenLock.Lock()
+	defer d.seenLock.Unlock()
+
+	seen := seenRequest{msg.Sender, msg.RequestID}
+	if _, ok := d.seen[seen]; ok {
+		return fmt.Errorf("request %d of %v was already received", msg.RequestID, msg.Sender)
+	}
+	// Once the window is over, a replay is rejected as stale.
+	d.seen[seen] = msg.Sent.Add(requestWindow)
+	return nil
+}
+
+// expireSeen forgets the requests received which can no longer be replayed,
+// and returns how many were forgotten.
+func (d *SDHT) expireSeen(now time.Time) int {
+	d.seenLock.Lock()
+	defer d.seenLock.Unlock()
+
+	count := 0
+	for seen, until := range d.seen {
+		if now.After(until) {
+			delete(d.seen, seen)
+			count++
+		}
+	}
+	return count
+}
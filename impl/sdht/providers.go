@@ -0,0 +1,213 @@
+package sdht
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sakshamsharma/sarga/common/iface"
+	"github.com/sakshamsharma/sarga/impl/slog"
+)
+
+// provider is a provider record announced by this node, which it keeps
+// re-announcing.
+type provider struct {
+	Addr iface.Address
+	TTL  time.Duration
+}
+
+// providerStore holds the provider records announced to this node. It is safe
+// for concurrent use.
+type providerStore struct {
+	// providers maps every key to the addresses of its providers, and to when
+	// their records expire.
+	providers map[string]map[iface.Address]time.Time
+	lock      *sync.Mutex
+}
+
+func newProviderStore() providerStore {
+	return providerStore{
+		providers: map[string]map[iface.Address]time.Time{},
+		lock:      &sync.Mutex{},
+	}
+}
+
+// add records that addr provides key until expires. An existing record for
+// the same address is replaced.
+func (s providerStore) add(key string, addr iface.Address, expires time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.providers[key] == nil {
+		s.providers[key] = map[iface.Address]time.Time{}
+	}
+	s.providers[key][addr] = expires
+}
+
+// get returns the providers of key whose records have not expired by now,
+// sorted by address.
+func (s providerStore) get(key string, now time.Time) []iface.Address {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	addrs := []iface.Address{}
+	for addr, expires := range s.providers[key] {
+		if !now.After(expires) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].String() < addrs[j].String()
+	})
+	return addrs
+}
+
+// snapshot returns a copy of the records which have not expired by now, with
+// when they expire.
+func (s providerStore) snapshot(now time.Time) map[string]map[iface.Address]time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	providers := map[string]map[iface.Address]time.Time{}
+	for key, addrs := range s.providers {
+		for addr, expires := range addrs {
+			if now.After(expires) {
+				continue
+			}
+			if providers[key] == nil {
+				providers[key] = map[iface.Address]time.Time{}
+			}
+			providers[key][addr] = expires
+		}
+	}
+	return providers
+}
+
+// expire deletes the records which have expired by now, and returns how many
+// were deleted.
+func (s providerStore) expire(now time.Time) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := 0
+	for key, addrs := range s.providers {
+		for addr, expires := range addrs {
+			if now.After(expires) {
+				delete(addrs, addr)
+				count++
+			}
+		}
+		if len(addrs) == 0 {
+			delete(s.providers, key)
+		}
+	}
+	return count
+}
+
+// AddProvider announces to the k nodes closest to key that the node at addr
+// provides it, and keeps re-announcing it every RepublishInterval. The records
+// expire ttl after they were last announced, or after the default TTL of
+// values if ttl is not positive, and after MaxTTL at most.
+func (d *SDHT) AddProvider(ctx context.Context, key string, addr iface.Address, ttl time.Duration) error {
+	keyID, _ := unmarshalID(key)
+	d.log.Println(slog.Verbose, d.id, "Sending AddProvider", keyID, "at", addr)
+
+	if ttl <= 0 {
+		ttl = d.defaultTTL()
+	}
+	if ttl > d.MaxTTL {
+		ttl = d.MaxTTL
+	}
+	p := provider{Addr: addr, TTL: ttl}
+	d.providingLock.Lock()
+	if d.providing[key] == nil {
+		d.providing[key] = map[iface.Address]provider{}
+	}
+	d.providing[key][addr] = p
+	d.providingLock.Unlock()
+
+	return d.announceProvider(ctx, key, p)
+}
+
+// announceProvider sends the provider record p for key to the k nodes closest
+// to key. An error is returned only if no node could store the record.
+func (d *SDHT) announceProvider(ctx context.Context, key string, p provider) error {
+	expires := d.Clock.Now().Add(p.TTL)
+	self := func() error {
+		d.providers.add(key, p.Addr, expires)
+		return nil
+	}
+	return d.sendToClosest(ctx, key, "announce provider", self, func(peer Peer) error {
+		return peer.AddProvider(ctx, d, key, p.Addr, p.TTL)
+	})
+}
+
+// reprovide re-announces every provider record announced by this node.
+func (d *SDHT) reprovide(ctx context.Context) {
+	d.providingLock.Lock()
+	providing := map[string][]provider{}
+	for key, providers := range d.providing {
+		for _, p := range providers {
+			providing[key] = append(providing[key], p)
+		}
+	}
+	d.providingLock.Unlock()
+
+	for key, providers := range providing {
+		keyID, _ := unmarshalID(key)
+		for _, p := range providers {
+			d.log.Println(slog.VVerbose, d.id, "re-announcing provider", p.Addr, "of key", keyID)
+			if err := d.announceProvider(ctx, key, p); err != nil {
+				d.log.Println(slog.Debug, d.id, "could not re-announce provider of key", keyID, ":", err)
+			}
+		}
+	}
+}
+
+// FindProviders asks the k nodes closest to key for the providers of key, and
+// returns all of them, sorted by address.
+func (d *SDHT) FindProviders(ctx context.Context, key string) ([]iface.Address, error) {
+	keyID, _ := unmarshalID(key)
+	d.log.Println(slog.Verbose, d.id, "wants providers of key", keyID)
+	peers, err := d.findClosestPeers(ctx, key, false)
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[iface.Address]bool{}
+	for _, addr := range d.providers.get(key, d.Clock.Now()) {
+		found[addr] = true
+	}
+	for _, p := range peers {
+		if p.ID == d.id {
+			continue
+		}
+		addrs, err := p.GetProviders(ctx, d, key)
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			d.log.Println(slog.Verbose, d.id, "could not get providers of key", keyID, "from", p.ID, ":", err)
+			d.setFailed(p)
+			continue
+		}
+		d.setAliveTime(p.ID)
+		for _, addr := range addrs {
+			found[addr] = true
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("did not find providers of key %v: %w", keyID, ErrNotFound)
+	}
+
+	addrs := []iface.Address{}
+	for addr := range found {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].String() < addrs[j].String()
+	})
+	return addrs, nil
+}
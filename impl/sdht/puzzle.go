@@ -0,0 +1,40 @@
+package sdht
+
+import (
+	"crypto/ed25519"
+	"crypto/sha1"
+	"io"
+)
+
+// validID returns true if id solves the crypto puzzle of the given difficulty,
+// that is if the hash of id has at least difficulty leading zero bits. Since
+// the ID of a node is the hash of its public key, and RPCs are signed with
+// that key, the only way to get a valid ID is to generate keys until one
+// solves the puzzle, which makes it costly to flood routing tables with nodes
+// close to a target key. As in S/Kademlia, the ID itself is not constrained,
+// so that valid IDs stay evenly spread over the key space. A difficulty of 0
+// makes every ID valid.
+func validID(id ID, difficulty int) bool {
+	if difficulty <= 0 {
+		return true
+	}
+	return distance(sha1.Sum(id[:])).prefixLen() >= difficulty
+}
+
+// generateKey generates keys until the ID derived from one is valid for the
+// given difficulty. Every additional bit of difficulty doubles the expected
+// number of keys generated.
+func generateKey(difficulty int) (ed25519.PrivateKey, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	for {
+		// Keys are derived from a seed read from keyReader, rather than by
+		// ed25519.GenerateKey, which may ignore its source of randomness.
+		if _, err := io.ReadFull(keyReader, seed); err != nil {
+			return nil, err
+		}
+		key := ed25519.NewKeyFromSeed(seed)
+		if validID(idFromKey(key.Public().(ed25519.PublicKey)), difficulty) {
+			return key, nil
+		}
+	}
+}
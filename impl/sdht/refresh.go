@@ -0,0 +1,35 @@
+package sdht
+
+import (
+	"context"
+	"time"
+
+	"github.com/sakshamsharma/sarga/impl/slog"
+)
+
+// DefaultRefreshInterval is how long a bucket can go without lookups in its
+// range before it is refreshed, used when SDHT.RefreshInterval is not set.
+const DefaultRefreshInterval = time.Hour
+
+// refresh runs a lookup for a random ID in every bucket which has not seen a
+// lookup for RefreshInterval. Buckets deeper than the deepest non-empty one
+// cover ranges too narrow to hold any known node, and are skipped.
+func (d *SDHT) refresh(ctx context.Context) {
+	deepest := -1
+	for i := range d.buckets.bs {
+		if len(d.buckets.bs[i].list()) != 0 {
+			deepest = i
+		}
+	}
+
+	for i := 0; i <= deepest; i++ {
+		if d.Clock.Now().Sub(d.buckets.bs[i].idleSince()) < d.RefreshInterval {
+			continue
+		}
+		key := d.id.randomIDInBucket(d.rand, i)
+		d.log.Println(slog.Verbose, d.id, "refreshing bucket", i, "using key", key)
+		if _, err := d.findClosestPeers(ctx, marshalID(key), true); err != nil {
+			d.log.Println(slog.Debug, d.id, "could not refresh bucket", i, ":", err)
+		}
+	}
+}
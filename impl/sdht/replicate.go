@@ -0,0 +1,233 @@
+package sdht
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sakshamsharma/sarga/impl/slog"
+)
+
+const (
+	// DefaultReplicateInterval is how often a node re-sends the values it
+	// holds to the k closest nodes, used when SDHT.ReplicateInterval is not
+	// set.
+	DefaultReplicateInterval = time.Hour
+	// DefaultRepublishInterval is how often a node re-sends the values it
+	// published itself, used when SDHT.RepublishInterval is not set.
+	DefaultRepublishInterval = 24 * time.Hour
+	// DefaultCacheTTL is how long a value found by a lookup is cached on the
+	// lookup path, used when SDHT.CacheTTL is not set.
+	DefaultCacheTTL = time.Hour
+	// DefaultMaxTTL is the longest a value stored by another node lives
+	// after being published, used when SDHT.MaxTTL is not set.
+	DefaultMaxTTL = 7 * 24 * time.Hour
+
+	// ttlMargin is how much longer than the republish interval values live
+	// by default, so that republished values do not expire in between.
+	ttlMargin = 10 * time.Second
+	// expireInterval is how often expired values are swept from storage.
+	expireInterval = time.Minute
+	// maxClockSkew is how far in the future the publish time of a stored
+	// value can be, to allow for the clocks of nodes to differ.
+	maxClockSkew = time.Minute
+)
+
+// defaultTTL is how long a value lives after being published, used when
+// StoreValue is not given a TTL. It is slightly longer than RepublishInterval.
+func (d *SDHT) defaultTTL() time.Duration {
+	return d.RepublishInterval + ttlMargin
+}
+
+// replicate sends every value held by this node to the k nodes closest to its
+// key, so that values survive their holders leaving.
+func (d *SDHT) replicate(ctx context.Context) {
+	for key, rec := range d.store.Snapshot() {
+		if rec.Cached {
+			continue
+		}
+		keyID, _ := unmarshalID(key)
+		d.log.Println(slog.VVerbose, d.id, "replicating key", keyID)
+		if err := d.storeAtClosest(ctx, key, rec, false); err != nil {
+			d.log.Println(slog.Debug, d.id, "could not replicate key", keyID, ":", err)
+		}
+	}
+}
+
+// republish sends every value originally published by this node to the k
+// nodes closest to its key, refreshing its publish time. Provider records
+// announced by this node are re-announced too.
+func (d *SDHT) republish(ctx context.Context) {
+	now := d.Clock.Now()
+	d.publishedLock.Lock()
+	published := map[string]record{}
+	for key, rec := range d.published {
+		rec.Published = now
+		d.published[key] = rec
+		published[key] = rec
+	}
+	d.publishedLock.Unlock()
+
+	for key, rec := range published {
+		keyID, _ := unmarshalID(key)
+		d.log.Println(slog.VVerbose, d.id, "republishing key", keyID)
+		if err := d.storeAtClosest(ctx, key, rec, true); err != nil {
+			d.log.Println(slog.Debug, d.id, "could not republish key", keyID, ":", err)
+		}
+	}
+	d.reprovide(ctx)
+}
+
+// expire deletes the values held by this node which have expired, and forgets
+// the requests it received which can no longer be replayed.
+func (d *SDHT) expire() {
+	now := d.Clock.Now()
+	if count := d.store.Expire(now); count != 0 {
+		d.log.Println(slog.Verbose, d.id, "expired", count, "values")
+	}
+	if count := d.providers.expire(now); count != 0 {
+		d.log.Println(slog.Verbose, d.id, "expired", count, "provider records")
+	}
+	if count := d.expireSeen(now); count != 0 {
+		d.log.Println(slog.VVerbose, d.id, "forgot", count, "received requests")
+	}
+}
+
+// storeAtClosest sends rec to the k nodes closest to key. If includeSelf is
+// not set, this node does not store the value even if it is among them. An
+// error is returned only if no node could store the value, which wraps
+// ErrConflict if a node holds a conflicting version.
+func (d *SDHT) storeAtClosest(ctx context.Context, key string, rec record, includeSelf bool) error {
+	var self func() error
+	if includeSelf {
+		self = func() error { return d.store.Set(key, rec) }
+	}
+	return d.sendToClosest(ctx, key, "store", self, func(p Peer) error {
+		return p.SendStore(ctx, d, key, rec)
+	})
+}
+
+// sendToClosest calls send for each of the k nodes closest to key, or self if
+// this node is among them and self is not nil. what names the request in logs.
+// Peers refusing with ErrConflict are not counted as failed. An error is
+// returned only if every call failed, and wraps ErrConflict if one did.
+func (d *SDHT) sendToClosest(ctx context.Context, key, what string, self func() error, send func(Peer) error) error {
+	peers, err := d.findClosestPeers(ctx, key, false)
+	if err != nil {
+		return err
+	}
+
+	sent := 0
+	var conflict error
+	sendSelf := func() {
+		if err := self(); err != nil {
+			conflict = err
+			return
+		}
+		sent++
+	}
+	if self != nil && len(peers) < d.K && indexOf(peers, d.id) < 0 {
+		// Fewer than k nodes are known, so this node is among the k closest.
+		sendSelf()
+	}
+	for _, p := range peers {
+		if p.ID == d.id {
+			if self != nil {
+				sendSelf()
+			}
+			continue
+		}
+		err = send(p)
+		switch {
+		case err == nil:
+			d.setAliveTime(p.ID)
+			sent++
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, ErrConflict):
+			// The peer answered, so it is alive.
+			d.log.Println(slog.Verbose, d.id, "was refused to", what, "by", p.ID, ":", err)
+			d.setAliveTime(p.ID)
+			conflict = err
+		default:
+			d.log.Println(slog.Verbose, d.id, "could not", what, "at", p.ID, ":", err)
+			d.setFailed(p)
+		}
+	}
+	switch {
+	case sent != 0:
+		return nil
+	case conflict != nil:
+		return conflict
+	default:
+		return err
+	}
+}
+
+// transferKeys is called when peer is newly seen, even if it only became a
+// replacement of a full bucket, since it may still be among the k closest
+// nodes to some keys. Every stored value for which both peer and this node are
+// among the k closest known nodes is sent to peer. Requiring this node to be
+// among the k closest limits how many holders send the same value.
+func (d *SDHT) transferKeys(peer Peer) {
+	d.background(func(ctx context.Context) {
+		known := d.buckets.all()
+		for key, rec := range d.store.Snapshot() {
+			keyID, _ := unmarshalID(key)
+			if rec.Cached || !d.shouldTransfer(keyID, peer, known) {
+				continue
+			}
+			d.log.Println(slog.VVerbose, d.id, "transferring key", keyID, "to", peer.ID)
+			if err := peer.SendStore(ctx, d, key, rec); err != nil {
+				d.log.Println(slog.Verbose, d.id, "could not transfer key", keyID, "to", peer.ID, ":", err)
+				d.setFailed(peer)
+			}
+		}
+	})
+}
+
+// shouldTransfer returns true if both peer and this node are among the k
+// nodes closest to key out of known, peer and this node.
+func (d *SDHT) shouldTransfer(key ID, peer Peer, known []Peer) bool {
+	self := d.getPeer()
+	candidates := []Peer{self, peer}
+	for _, p := range known {
+		if p.ID != peer.ID {
+			candidates = append(candidates, p)
+		}
+	}
+
+	closerThanSelf, closerThanPeer := 0, 0
+	for _, p := range candidates {
+		if isBetter(key, p, self) {
+			closerThanSelf++
+		}
+		if isBetter(key, p, peer) {
+			closerThanPeer++
+		}
+	}
+	return closerThanSelf < d.K && closerThanPeer < d.K
+}
+
+// cacheValue stores data at peer, the closest node on a lookup path which did
+// not have it. The copy is marked as cached, and its TTL is halved for each of
+// the between nodes closer to the key than peer.
+func (d *SDHT) cacheValue(peer Peer, key string, data []byte, between int) {
+	ttl := d.CacheTTL >> uint(min(between, 32))
+	if ttl <= 0 {
+		return
+	}
+	rec := record{
+		Data:      data,
+		Published: d.Clock.Now(),
+		TTL:       ttl,
+		Cached:    true,
+	}
+	d.background(func(ctx context.Context) {
+		keyID, _ := unmarshalID(key)
+		d.log.Println(slog.VVerbose, d.id, "caching key", keyID, "at", peer.ID, "for", ttl)
+		if err := peer.SendStore(ctx, d, key, rec); err != nil {
+			d.log.Println(slog.Verbose, d.id, "could not cache key", keyID, "at", peer.ID, ":", err)
+		}
+	})
+}
@@ -1,9 +1,19 @@
 package sdht
 
+import (
+	"time"
+
+	"github.com/sakshamsharma/sarga/common/iface"
+)
+
 type storeReq struct {
-	ID   ID
-	Key  string
-	Data string
+	ID        ID
+	Key       string
+	Data      []byte
+	Published time.Time
+	TTL       time.Duration
+	Cached    bool
+	Mutable   bool
 }
 
 type findNodeReq struct {
@@ -11,9 +21,12 @@ type findNodeReq struct {
 	Key   string
 }
 
+type storeResp struct{}
+
 type findNodeResp struct {
-	Error error
 	Peers []Peer
+	// Observed is the address the request was received from.
+	Observed iface.Address
 }
 
 type findValueReq struct {
@@ -22,7 +35,6 @@ type findValueReq struct {
 }
 
 type findValueResp struct {
-	Error error
 	Data  []byte
 	Peers []Peer
 }
@@ -31,13 +43,38 @@ type exitReq struct {
 	ID ID
 }
 
+type exitResp struct {
+	ID ID
+}
+
+type addProviderReq struct {
+	ID       ID
+	Key      string
+	Provider iface.Address
+	TTL      time.Duration
+}
+
+type addProviderResp struct{}
+
+type getProvidersReq struct {
+	ID  ID
+	Key string
+}
+
+type getProvidersResp struct {
+	Providers []iface.Address
+}
+
 type pingResp struct {
 	ID ID
+	// Observed is the address the request was received from.
+	Observed iface.Address
 }
 
 type infoResp struct {
-	ID      string
-	Port    int
-	Storage string
-	Buckets string
+	ID       string
+	Port     int
+	Storage  string
+	Buckets  string
+	Liveness string
 }
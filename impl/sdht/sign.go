@@ -0,0 +1,70 @@
+package sdht
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// keyReader is the source of randomness node keys are generated from. Tests
+// replace it to get reproducible IDs.
+var keyReader io.Reader = rand.Reader
+
+// envelope wraps the body of every RPC request and response. It is signed by
+// the sender, whose ID is derived from its public key, so that no node can
+// claim an ID it does not hold the key for.
+type envelope struct {
+	Key       []byte
+	Body      []byte
+	Signature []byte
+}
+
+// idFromKey derives the ID of a node from its public key.
+func idFromKey(key ed25519.PublicKey) ID {
+	return ID(sha1.Sum(key))
+}
+
+// signedPayload returns what is signed for a message, binding the body to the
+// RPC it was sent for, and to whether it is a request or a response.
+func signedPayload(domain string, body []byte) []byte {
+	return append([]byte(domain+"\x00"), body...)
+}
+
+func requestDomain(action string) string {
+	return "req:" + action
+}
+
+func responseDomain(action string) string {
+	return "resp:" + action
+}
+
+// seal encodes msg with c, and wraps it in an envelope signed for domain.
+func (d *SDHT) seal(c codec, domain string, msg interface{}) []byte {
+	body := c.encode(msg)
+	return c.encode(envelope{
+		Key:       d.key.Public().(ed25519.PublicKey),
+		Body:      body,
+		Signature: ed25519.Sign(d.key, signedPayload(domain, body)),
+	})
+}
+
+// openEnvelope verifies that data is an envelope correctly signed for domain.
+// It returns the body of the envelope, the ID of the sender, and the codec the
+// envelope was encoded with.
+func openEnvelope(domain string, data []byte) ([]byte, ID, codec, error) {
+	c := detectCodec(data)
+	env := envelope{}
+	if err := c.decode(data, &env); err != nil {
+		return nil, ID{}, nil, fmt.Errorf("invalid envelope: %v", err)
+	}
+	if len(env.Key) != ed25519.PublicKeySize {
+		return nil, ID{}, nil, errors.New("invalid public key in envelope")
+	}
+	if !ed25519.Verify(env.Key, signedPayload(domain, env.Body), env.Signature) {
+		return nil, ID{}, nil, errors.New("invalid signature in envelope")
+	}
+	return env.Body, idFromKey(env.Key), c, nil
+}
@@ -0,0 +1,102 @@
+package sdht
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sakshamsharma/sarga/common/iface"
+	"github.com/sakshamsharma/sarga/impl/slog"
+)
+
+// DefaultSnapshotInterval is how often the routing table is saved, used when
+// SDHT.SnapshotInterval is not set.
+const DefaultSnapshotInterval = 10 * time.Minute
+
+// savedPeer is the on-disk representation of a peer of the routing table.
+type savedPeer struct {
+	ID   string
+	Addr string
+}
+
+// saveRoutingTable writes the peers of the routing table to RoutingTableFile.
+func (d *SDHT) saveRoutingTable() {
+	saved := []savedPeer{}
+	for _, p := range d.buckets.all() {
+		saved = append(saved, savedPeer{ID: marshalID(p.ID), Addr: p.Addr.String()})
+	}
+
+	path := d.RoutingTableFile
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		d.log.Println(slog.Error, d.id, "could not save routing table:", err)
+		return
+	}
+	// Write to a temporary file first, so that a crash never leaves a
+	// truncated table behind.
+	if err := ioutil.WriteFile(path+".tmp", marshal(saved), 0600); err != nil {
+		d.log.Println(slog.Error, d.id, "could not save routing table:", err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		d.log.Println(slog.Error, d.id, "could not save routing table:", err)
+		return
+	}
+	d.log.Println(slog.Verbose, d.id, "saved", len(saved), "peers to", path)
+}
+
+// loadRoutingTable reads the peers saved in RoutingTableFile, pings them in
+// parallel, and inserts the live ones in the routing table. It returns their
+// addresses.
+func (d *SDHT) loadRoutingTable(ctx context.Context) []iface.Address {
+	bytes, err := ioutil.ReadFile(d.RoutingTableFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		d.log.Println(slog.Error, d.id, "could not load routing table:", err)
+		return nil
+	}
+	saved := []savedPeer{}
+	if err := json.Unmarshal(bytes, &saved); err != nil {
+		d.log.Println(slog.Error, d.id, "invalid routing table in", d.RoutingTableFile, ":", err)
+		return nil
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	live := []iface.Address{}
+	for _, sp := range saved {
+		id, err := unmarshalID(sp.ID)
+		if err != nil {
+			continue
+		}
+		addr, err := iface.ParseAddress(sp.Addr)
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(p Peer) {
+			defer wg.Done()
+			// The response to the ping is signed, so a saved peer is only
+			// inserted if its ID is still reachable at its address.
+			if err := d.pingPeer(ctx, p); err != nil {
+				d.log.Println(slog.Debug, d.id, "saved peer", p.ID, "is gone:", err)
+				return
+			}
+			d.buckets.insert(d.id, p)
+
+			lock.Lock()
+			live = append(live, p.Addr)
+			lock.Unlock()
+		}(Peer{ID: id, Addr: addr})
+	}
+	wg.Wait()
+
+	d.log.Println(slog.Debug, d.id, "rejoined through", len(live), "of", len(saved), "saved peers")
+	return live
+}
@@ -0,0 +1,89 @@
+package sdht
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/sakshamsharma/sarga/common/dht"
+)
+
+// Errors returned by Peer RPCs for the status a peer answered with, and by the
+// SDHT itself. Use errors.Is to check for them.
+var (
+	ErrNotFound   = dht.ErrNotFound
+	ErrBadRequest = errors.New("bad request")
+	ErrOverloaded = errors.New("overloaded")
+	ErrInternal   = errors.New("internal error")
+	ErrConflict   = dht.ErrConflict
+)
+
+// status is the outcome of an RPC, as sent on the wire.
+type status int
+
+const (
+	statusOK status = iota
+	statusNotFound
+	statusBadRequest
+	statusOverloaded
+	statusInternal
+	statusConflict
+)
+
+// response wraps the body of every RPC response, along with its status. If
+// the status is not statusOK, Message describes the error and Body is empty.
+type response struct {
+	Status  status
+	Message string
+	Body    json.RawMessage
+}
+
+// statusOf returns the status to answer with for err.
+func statusOf(err error) status {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return statusNotFound
+	case errors.Is(err, ErrBadRequest):
+		return statusBadRequest
+	case errors.Is(err, ErrOverloaded):
+		return statusOverloaded
+	case errors.Is(err, ErrConflict):
+		return statusConflict
+	default:
+		return statusInternal
+	}
+}
+
+// remoteError is an error a peer answered with. It wraps the sentinel error
+// of its status.
+type remoteError struct {
+	sentinel error
+	message  string
+}
+
+func (e remoteError) Error() string {
+	return e.message
+}
+
+func (e remoteError) Unwrap() error {
+	return e.sentinel
+}
+
+// err returns the error the response carries, if any.
+func (r response) err() error {
+	var sentinel error
+	switch r.Status {
+	case statusOK:
+		return nil
+	case statusNotFound:
+		sentinel = ErrNotFound
+	case statusBadRequest:
+		sentinel = ErrBadRequest
+	case statusOverloaded:
+		sentinel = ErrOverloaded
+	case statusConflict:
+		sentinel = ErrConflict
+	default:
+		sentinel = ErrInternal
+	}
+	return remoteError{sentinel, r.Message}
+}
@@ -1,30 +1,145 @@
 package sdht
 
-import "errors"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
 
-type Storage map[string][]byte
+// record is a value held in Storage.
+type record struct {
+	Data []byte
+	// Published is the time at which the value was last published by its
+	// original publisher.
+	Published time.Time
+	// TTL is how long the value lives after being published.
+	TTL time.Duration
+	// Cached is set for copies cached along a lookup path, which are neither
+	// replicated nor handed off.
+	Cached bool
+	// Mutable is set for versions of a mutable record, Seq being the version.
+	Mutable bool
+	Seq     int64
+}
+
+func (r record) expires() time.Time {
+	return r.Published.Add(r.TTL)
+}
+
+func (r record) expired(now time.Time) bool {
+	return now.After(r.expires())
+}
+
+// Storage holds the values stored at this node. It is safe for concurrent
+// use.
+type Storage struct {
+	data map[string]record
+	lock *sync.RWMutex
+	// now tells the time records expire against.
+	now func() time.Time
+}
+
+func newStorage(now func() time.Time) Storage {
+	return Storage{
+		data: map[string]record{},
+		lock: &sync.RWMutex{},
+		now:  now,
+	}
+}
 
 func (s Storage) Get(key string) ([]byte, error) {
-	if val, ok := s[key]; ok {
-		return val, nil
+	rec, err := s.GetRecord(key)
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("value not found")
+	return rec.Data, nil
 }
 
-func (s Storage) Set(key string, val []byte) error {
-	s[key] = val
+// GetRecord returns the record stored for key, unless it has expired.
+func (s Storage) GetRecord(key string) (record, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if rec, ok := s.data[key]; ok && !rec.expired(s.now()) {
+		return rec, nil
+	}
+	return record{}, errors.New("value not found")
+}
+
+// Set stores rec for key, unless the record already stored expires later. A
+// cached record never replaces an original one, and an original record always
+// replaces a cached one. A mutable record is only replaced by a version with a
+// higher sequence number, or by the same version expiring later; anything
+// else is rejected with an error wrapping ErrConflict.
+func (s Storage) Set(key string, rec record) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if old, ok := s.data[key]; ok && !old.expired(s.now()) {
+		switch {
+		case old.Mutable && !rec.Mutable:
+			return fmt.Errorf("%w: a mutable record is stored under the key", ErrConflict)
+		case old.Mutable && (rec.Seq < old.Seq || rec.Seq == old.Seq && !bytes.Equal(rec.Data, old.Data)):
+			return fmt.Errorf("%w: version %d of the mutable record is stored", ErrConflict, old.Seq)
+		case old.Mutable && rec.Seq > old.Seq:
+		case rec.Mutable && !old.Mutable:
+			// Only the publisher can produce a signed record for the key, so
+			// what was stored before was not legitimate.
+		case rec.Cached && !old.Cached:
+			return nil
+		case rec.Cached == old.Cached && old.expires().After(rec.expires()):
+			return nil
+		}
+	}
+	s.data[key] = rec
 	return nil
 }
 
 func (s Storage) Del(key string) error {
-	delete(s, key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.data, key)
 	return nil
 }
 
+// Expire deletes the records which have expired by now, and returns how many
+// were deleted.
+func (s Storage) Expire(now time.Time) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := 0
+	for key, rec := range s.data {
+		if rec.expired(now) {
+			delete(s.data, key)
+			count++
+		}
+	}
+	return count
+}
+
+// Snapshot returns a copy of all the records which have not expired.
+func (s Storage) Snapshot() map[string]record {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	now := s.now()
+	ret := map[string]record{}
+	for key, rec := range s.data {
+		if !rec.expired(now) {
+			ret[key] = rec
+		}
+	}
+	return ret
+}
+
 func (s Storage) Marshal() string {
 	tmpMap := map[string]string{}
-	for key, val := range s {
-		tmpMap[key] = string(val)
+	for key, rec := range s.Snapshot() {
+		tmpMap[key] = string(rec.Data)
 	}
 	return string(marshal(tmpMap))
 }
@@ -0,0 +1,49 @@
+package sdht
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStorageExpiry(t *testing.T) {
+	s := newStorage(time.Now)
+	now := time.Now()
+	s.Set("old", record{Data: []byte("old"), Published: now.Add(-2 * time.Hour), TTL: time.Hour})
+	s.Set("new", record{Data: []byte("new"), Published: now, TTL: time.Hour})
+
+	if _, err := s.Get("old"); err == nil {
+		t.Fatalf("expected expired value to not be returned")
+	}
+	if _, err := s.Get("new"); err != nil {
+		t.Fatalf("expected live value to be returned, got: %v", err)
+	}
+
+	// An older copy of a value does not overwrite a newer one.
+	s.Set("new", record{Data: []byte("stale"), Published: now.Add(-time.Minute), TTL: time.Hour})
+	if val, _ := s.Get("new"); string(val) != "new" {
+		t.Fatalf("expected value %q to be kept, got %q", "new", val)
+	}
+
+	// Stale versions of a mutable record are refused.
+	s.Set("mutable", record{Data: []byte("v2"), Published: now, TTL: time.Hour, Mutable: true, Seq: 2})
+	for _, rec := range []record{
+		{Data: []byte("v1"), Published: now, TTL: 2 * time.Hour, Mutable: true, Seq: 1},
+		{Data: []byte("other"), Published: now, TTL: 2 * time.Hour, Mutable: true, Seq: 2},
+		{Data: []byte("plain"), Published: now, TTL: 2 * time.Hour},
+	} {
+		if err := s.Set("mutable", rec); !errors.Is(err, ErrConflict) {
+			t.Fatalf("expected %q to be refused as a conflict, got: %v", rec.Data, err)
+		}
+	}
+	if err := s.Set("mutable", record{Data: []byte("v2"), Published: now, TTL: 2 * time.Hour, Mutable: true, Seq: 2}); err != nil {
+		t.Fatalf("expected the same version to be refreshed, got: %v", err)
+	}
+
+	if count := s.Expire(now); count != 1 {
+		t.Fatalf("expected 1 value to expire, got %d", count)
+	}
+	if count := s.Expire(now.Add(3 * time.Hour)); count != 2 {
+		t.Fatalf("expected 2 values to expire, got %d", count)
+	}
+}
@@ -1,53 +1,89 @@
 package testnet
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"sync"
 
 	"github.com/sakshamsharma/sarga/common/dht"
 	"github.com/sakshamsharma/sarga/common/iface"
 )
 
-// TestNet is used for unit tests of DHT.
-// TODO: Errors are not handled well yet.
+var (
+	// ErrUnreachable is returned for requests to addresses with no running
+	// DHT.
+	ErrUnreachable = errors.New("address unreachable")
+	// ErrLost is returned for requests whose request or response was lost.
+	ErrLost = errors.New("message lost")
+	// ErrPartitioned is returned for requests between nodes on either side of
+	// a partition.
+	ErrPartitioned = errors.New("network partitioned")
+)
+
+// TestNet is used for unit tests of DHT. Requests are delivered by calling
+// Respond on the DHT at the address synchronously. It is safe for concurrent
+// use.
 type TestNet struct {
-	DHTs map[iface.Address]dht.DHT
+	dhts map[iface.Address]dht.DHT
+	lock sync.RWMutex
 }
 
 var _ iface.Net = &TestNet{}
 
 func InitTestNet() *TestNet {
-	return &TestNet{DHTs: map[iface.Address]dht.DHT{}}
+	return &TestNet{dhts: map[iface.Address]dht.DHT{}}
 }
 
-func (n *TestNet) Get(addr iface.Address, path string) ([]byte, error) {
-	if _, ok := n.DHTs[addr]; !ok {
-		log.Fatalf("address not found: %v", addr.String())
-		return nil, fmt.Errorf("address not found: %v", addr.String())
-	}
-	return n.DHTs[addr].Respond(path, nil), nil
+// Add makes d reachable at addr.
+func (n *TestNet) Add(addr iface.Address, d dht.DHT) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.dhts[addr] = d
+}
+
+// Remove makes addr unreachable.
+func (n *TestNet) Remove(addr iface.Address) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	delete(n.dhts, addr)
 }
 
-func (n *TestNet) Put(addr iface.Address, path string, data []byte) error {
-	if _, ok := n.DHTs[addr]; !ok {
-		log.Fatalf("address not found: %v", addr.String())
-		return fmt.Errorf("address not found: %v", addr.String())
+func (n *TestNet) lookup(addr iface.Address) (dht.DHT, error) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	if d, ok := n.dhts[addr]; ok {
+		return d, nil
 	}
-	n.DHTs[addr].Respond(path, data)
-	return nil
+	return nil, fmt.Errorf("%w: %v", ErrUnreachable, addr)
+}
+
+func (n *TestNet) Get(ctx context.Context, addr iface.Address, path string) ([]byte, error) {
+	return n.Post(ctx, addr, path, nil)
 }
 
-func (n *TestNet) Post(addr iface.Address, path string, data []byte) ([]byte, error) {
-	if _, ok := n.DHTs[addr]; !ok {
-		log.Fatalf("address not found: %v", addr)
-		return nil, fmt.Errorf("address not found: %v", addr)
+func (n *TestNet) Put(ctx context.Context, addr iface.Address, path string, data []byte) error {
+	_, err := n.Post(ctx, addr, path, data)
+	return err
+}
+
+func (n *TestNet) Post(ctx context.Context, addr iface.Address, path string, data []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d, err := n.lookup(addr)
+	if err != nil {
+		return nil, err
 	}
-	return n.DHTs[addr].Respond(path, data), nil
+	return d.Respond(ctx, path, data), nil
 }
 
 // Listen simply blocks till shutdown. Since we control the network, we will
 // directly call the member functions during the unit tests.
-func (n *TestNet) Listen(_ iface.Address, _ func(string, []byte) []byte, shutdown chan bool) error {
+func (n *TestNet) Listen(_ iface.Address, _ func(context.Context, string, []byte) []byte, shutdown chan bool) error {
 	for {
 		select {
 		case <-shutdown:
@@ -0,0 +1,256 @@
+package testnet
+
+import (
+	"bytes"
+	"container/heap"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"github.com/sakshamsharma/sarga/common/iface"
+)
+
+// simEpoch is the time of the virtual clock when a Sim starts.
+var simEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// The phases of events, in the order events due at the same time run.
+const (
+	// timerEvent fires a timer of the clock.
+	timerEvent = iota
+	// deadlineEvent times out a request.
+	deadlineEvent
+	// arrivalEvent hands a request to its recipient.
+	arrivalEvent
+	// responseEvent hands a response to the requester.
+	responseEvent
+)
+
+// event is something due on the virtual clock of a Sim.
+type event struct {
+	at    time.Duration
+	phase int
+	// key and seq order the events of a phase due at the same time: the key
+	// of their request for messages, the order they were set in for timers.
+	key  string
+	seq  uint64
+	fire func()
+	// index is the position of the event in its queue, or -1 once it left it.
+	index int
+}
+
+// eventQueue is a heap of events, the next one due first.
+type eventQueue []*event
+
+var _ heap.Interface = &eventQueue{}
+
+func (q eventQueue) Len() int {
+	return len(q)
+}
+
+func (q eventQueue) Less(i, j int) bool {
+	a, b := q[i], q[j]
+	switch {
+	case a.at != b.at:
+		return a.at < b.at
+	case a.phase != b.phase:
+		return a.phase < b.phase
+	case a.key != b.key:
+		return a.key < b.key
+	}
+	return a.seq < b.seq
+}
+
+func (q eventQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *eventQueue) Push(x interface{}) {
+	e := x.(*event)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	e.index = -1
+	return e
+}
+
+// schedule queues fire to run once delay has passed, as an event of the given
+// phase and key. Caller must hold the lock.
+func (s *Sim) schedule(delay time.Duration, phase int, key string, fire func()) *event {
+	if delay < 0 {
+		delay = 0
+	}
+	s.scheduled++
+	e := &event{at: s.now + delay, phase: phase, key: key, seq: s.scheduled, fire: fire}
+	heap.Push(&s.events, e)
+	s.wake.Broadcast()
+	return e
+}
+
+// due returns whether the scheduler has something to do: an event to run, or
+// an Advance to end. Caller must hold the lock.
+func (s *Sim) due() bool {
+	if len(s.events) != 0 && (s.pending != 0 || s.events[0].at <= s.until) {
+		return true
+	}
+	return s.reached < s.until
+}
+
+// scheduling is held by the scheduler of a Sim while it waits for the Sim to
+// be quiet and runs an event, so that the schedulers of several Sims do not
+// keep each other from seeing their Sims quiet.
+var scheduling sync.Mutex
+
+// run is the scheduler of the Sim. It runs the next event, or moves the clock
+// to the end of an Advance, whenever the Sim is quiet.
+func (s *Sim) run() {
+	for {
+		s.lock.Lock()
+		for !s.due() {
+			s.wake.Wait()
+		}
+		s.lock.Unlock()
+
+		scheduling.Lock()
+		s.settle()
+		s.lock.Lock()
+		switch {
+		case s.reached < s.until && (len(s.events) == 0 || s.events[0].at > s.until):
+			// Everything due by the end of the Advance is done.
+			if s.now < s.until {
+				s.now = s.until
+			}
+			s.reached = s.until
+		case len(s.events) != 0 && (s.pending != 0 || s.events[0].at <= s.until):
+			e := heap.Pop(&s.events).(*event)
+			if e.at > s.now {
+				s.now = e.at
+			}
+			e.fire()
+		}
+		s.wake.Broadcast()
+		s.lock.Unlock()
+		scheduling.Unlock()
+	}
+}
+
+// schedMetrics count the goroutines which are not blocked, on runtimes which
+// have them.
+var schedMetrics = []string{
+	"/sched/goroutines/running:goroutines",
+	"/sched/goroutines/runnable:goroutines",
+	"/sched/goroutines/not-in-go:goroutines",
+}
+
+// busyStates are the states of goroutines which are not blocked, as listed by
+// runtime.Stack.
+var busyStates = [][]byte{
+	[]byte("running"),
+	[]byte("runnable"),
+	[]byte("syscall"),
+	[]byte("preempted"),
+	[]byte("GC assist"),
+	[]byte("copystack"),
+}
+
+// scheduler marks the goroutine of the scheduler in stacks.
+var scheduler = []byte("testnet.(*Sim).run(")
+
+// settle waits until the Sim is quiet: every goroutine, except for the
+// scheduler, is blocked. Since goroutines are counted on the fly, the Sim must
+// be seen quiet twice in a row.
+func (s *Sim) settle() {
+	for quiet := 0; quiet < 2; {
+		runtime.Gosched()
+		if s.quiet() {
+			quiet++
+		} else {
+			quiet = 0
+		}
+	}
+}
+
+// quiet returns whether every goroutine, except for the scheduler, is
+// blocked. Goroutines are counted with runtime/metrics if the runtime has the
+// metrics, and listed with runtime.Stack otherwise, which takes much longer.
+func (s *Sim) quiet() bool {
+	if running, others, ok := s.count(); ok {
+		if others == 0 && running > 1 {
+			// Idle processors looking for work are counted as running, and
+			// stop looking once the scheduler sleeps.
+			time.Sleep(time.Microsecond)
+			running, others, _ = s.count()
+		}
+		return running <= 1 && others == 0
+	}
+
+	n := runtime.Stack(s.stacks, true)
+	for n == len(s.stacks) {
+		s.stacks = make([]byte, 2*len(s.stacks))
+		n = runtime.Stack(s.stacks, true)
+	}
+	for _, g := range bytes.Split(s.stacks[:n], []byte("\n\n")) {
+		// Goroutines are listed as "goroutine 1 [state, more]:".
+		start, end := bytes.IndexByte(g, '['), bytes.IndexByte(g, ']')
+		if start < 0 || end < start || bytes.Contains(g, scheduler) {
+			continue
+		}
+		for _, state := range busyStates {
+			if bytes.HasPrefix(g[start+1:end], state) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// count returns the number of running goroutines, and of the other ones which
+// are not blocked, if the runtime has the metrics.
+func (s *Sim) count() (running, others uint64, ok bool) {
+	metrics.Read(s.samples)
+	for _, sample := range s.samples {
+		if sample.Value.Kind() != metrics.KindUint64 {
+			return 0, 0, false
+		}
+	}
+	return s.samples[0].Value.Uint64(), s.samples[1].Value.Uint64() + s.samples[2].Value.Uint64(), true
+}
+
+// simClock is the virtual clock of a Sim.
+type simClock struct {
+	sim *Sim
+}
+
+var _ iface.Clock = simClock{}
+
+func (c simClock) Now() time.Time {
+	c.sim.lock.Lock()
+	defer c.sim.lock.Unlock()
+
+	return simEpoch.Add(c.sim.now)
+}
+
+func (c simClock) AfterFunc(d time.Duration, f func()) func() bool {
+	s := c.sim
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e := s.schedule(d, timerEvent, "", func() { go f() })
+	return func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		if e.index < 0 {
+			return false
+		}
+		heap.Remove(&s.events, e.index)
+		return true
+	}
+}
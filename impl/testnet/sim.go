@@ -0,0 +1,424 @@
+package testnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"github.com/sakshamsharma/sarga/common/dht"
+	"github.com/sakshamsharma/sarga/common/iface"
+)
+
+// Latency is a distribution of one-way message latencies, drawn from r.
+type Latency func(r *rand.Rand) time.Duration
+
+// Constant returns a latency distribution which is always d.
+func Constant(d time.Duration) Latency {
+	return func(*rand.Rand) time.Duration {
+		return d
+	}
+}
+
+// Uniform returns a latency distribution uniform in [min, max).
+func Uniform(min, max time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(r.Int63n(int64(max-min)))
+	}
+}
+
+// Exponential returns an exponential latency distribution of the given mean,
+// shifted by min.
+func Exponential(min, mean time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		return min + time.Duration(r.ExpFloat64()*float64(mean))
+	}
+}
+
+// Link describes how messages travel from a node to another.
+type Link struct {
+	// Latency is the distribution of the latency of messages. Messages are
+	// instantaneous if nil.
+	Latency Latency
+	// Loss is the probability that a message is lost.
+	Loss float64
+}
+
+// link is the directed link from an address to another.
+type link struct {
+	from, to iface.Address
+}
+
+// partition separates side from the other nodes while the virtual clock is in
+// [start, end).
+type partition struct {
+	side       map[iface.Address]bool
+	start, end time.Duration
+}
+
+func (p partition) separates(l link, now time.Duration) bool {
+	return now >= p.start && now < p.end && p.side[l.from] != p.side[l.to]
+}
+
+type simNode struct {
+	dht dht.DHT
+	up  bool
+}
+
+// Sim is a simulated network of DHTs, in which links have latencies and lose
+// messages, partitions come and heal, and nodes crash and restart. Failures
+// are returned as errors wrapping ErrUnreachable, ErrLost, ErrPartitioned or
+// the error of the context of the request.
+//
+// Time in the simulation is a virtual clock, read with Clock. Messages are
+// events delivered once their latency has passed on it, along with the timers
+// of the clock, in the order they are due. The clock only moves forward while
+// requests are in flight, or during Advance, and only once every goroutine is
+// blocked, so that the work caused by an event is done before the next one.
+// Goroutines sleeping or waiting on the real clock are taken for blocked, so
+// nodes must not. The deadlines of requests are read on the virtual clock, so
+// contexts must be made with iface.WithTimeout and the clock of the Sim.
+//
+// Every request draws its latencies and losses from its own random source,
+// derived from the seed of the Sim and from the number of requests sent before
+// it with the same path on the same link. Nodes which run on the clock of the
+// Sim and draw nothing else at random thus make the same run, as listed by
+// Trace, for the same seed, unless they send several requests with the same
+// path on a link at the same instant.
+//
+// Each node sends requests through the iface.Net returned by Net for its
+// address. It is safe for concurrent use.
+type Sim struct {
+	seed  int64
+	now   time.Duration
+	nodes map[iface.Address]*simNode
+	// links overrides defaultLink for some links.
+	links       map[link]Link
+	defaultLink Link
+	// sent counts the requests sent so far with each path on each link.
+	sent       map[string]int
+	partitions []partition
+	// events holds the messages and timers due on the virtual clock. They are
+	// run while pending requests wait for them, or up to until, the end of the
+	// last Advance. reached is the end of the last Advance done.
+	events    eventQueue
+	scheduled uint64
+	pending   int
+	until     time.Duration
+	reached   time.Duration
+	trace     []string
+	lock      sync.Mutex
+	// wake is signalled whenever the state of the clock changes.
+	wake *sync.Cond
+	// samples and stacks are where the scheduler counts goroutines.
+	samples []metrics.Sample
+	stacks  []byte
+}
+
+// NewSim returns an empty Sim whose random sources are derived from seed.
+// Links are instantaneous and lossless until set otherwise.
+func NewSim(seed int64) *Sim {
+	s := &Sim{
+		seed:   seed,
+		nodes:  map[iface.Address]*simNode{},
+		links:  map[link]Link{},
+		sent:   map[string]int{},
+		stacks: make([]byte, 1<<16),
+	}
+	for _, name := range schedMetrics {
+		s.samples = append(s.samples, metrics.Sample{Name: name})
+	}
+	s.wake = sync.NewCond(&s.lock)
+	go s.run()
+	return s
+}
+
+// Add makes d reachable at addr.
+func (s *Sim) Add(addr iface.Address, d dht.DHT) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.nodes[addr] = &simNode{dht: d, up: true}
+}
+
+// Net returns the network as seen by the node at addr, through which it must
+// send its requests.
+func (s *Sim) Net(addr iface.Address) iface.Net {
+	return &simNet{sim: s, addr: addr}
+}
+
+// SetDefaultLink sets how messages travel on the links with no Link of their
+// own.
+func (s *Sim) SetDefaultLink(l Link) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.defaultLink = l
+}
+
+// SetLink sets how messages travel from the node at from to the node at to.
+// The reverse direction is not affected.
+func (s *Sim) SetLink(from, to iface.Address, l Link) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.links[link{from, to}] = l
+}
+
+// Partition separates the nodes in side from all the other nodes for duration,
+// starting start from now on the virtual clock. The partition heals once the
+// clock is advanced past its end.
+func (s *Sim) Partition(start, duration time.Duration, side ...iface.Address) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	p := partition{side: map[iface.Address]bool{}, start: s.now + start, end: s.now + start + duration}
+	for _, addr := range side {
+		p.side[addr] = true
+	}
+	s.partitions = append(s.partitions, p)
+}
+
+// Now returns the time elapsed on the virtual clock.
+func (s *Sim) Now() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.now
+}
+
+// Clock returns the virtual clock, which nodes must run on.
+func (s *Sim) Clock() iface.Clock {
+	return simClock{s}
+}
+
+// Advance lets d pass on the virtual clock, delivering the messages and
+// firing the timers due by then. It returns once the work they caused is
+// done.
+func (s *Sim) Advance(d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	target := s.now + d
+	if target > s.until {
+		s.until = target
+	}
+	s.wake.Broadcast()
+	for s.reached < target {
+		s.wake.Wait()
+	}
+}
+
+// Trace returns what happened to every request so far, in order.
+func (s *Sim) Trace() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string{}, s.trace...)
+}
+
+// Crash makes the node at addr unreachable, and fails its own requests, as if
+// its process had died. The DHT is not shut down, so that it does not leave
+// the network gracefully; its background tasks are left to the caller.
+func (s *Sim) Crash(addr iface.Address) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if n, ok := s.nodes[addr]; ok {
+		n.up = false
+	}
+}
+
+// Restart makes d reachable at addr again after a crash. d is usually a new
+// DHT, since a crashed node loses the state it kept in memory.
+func (s *Sim) Restart(addr iface.Address, d dht.DHT) {
+	s.Add(addr, d)
+}
+
+// call is a request in flight.
+type call struct {
+	link
+	path string
+	data []byte
+	ctx  context.Context
+	// key names the request in the trace, and orders its events.
+	key string
+	// rand is the random source the fate of the request is drawn from.
+	rand *rand.Rand
+	done chan struct{}
+	resp []byte
+	err  error
+}
+
+// newCall returns a request for path on l, with its own random source.
+// Caller must hold the lock.
+func (s *Sim) newCall(ctx context.Context, l link, path string, data []byte) *call {
+	prefix := fmt.Sprintf("%v>%v %s", l.from, l.to, path)
+	key := fmt.Sprintf("%s #%d", prefix, s.sent[prefix])
+	s.sent[prefix]++
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return &call{
+		link: l,
+		path: path,
+		data: data,
+		ctx:  ctx,
+		key:  key,
+		rand: rand.New(rand.NewSource(s.seed ^ int64(h.Sum64()))),
+		done: make(chan struct{}),
+	}
+}
+
+// finish ends c with resp and err, unless it already ended. Caller must hold
+// the lock.
+func (s *Sim) finish(c *call, resp []byte, err error) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.resp, c.err = resp, err
+	close(c.done)
+	if err != nil {
+		s.record(c, err.Error())
+	} else {
+		s.record(c, "answered")
+	}
+}
+
+// record adds what happened to c to the trace. Caller must hold the lock.
+func (s *Sim) record(c *call, what string) {
+	s.trace = append(s.trace, fmt.Sprintf("%v %s: %s", s.now, c.key, what))
+}
+
+// send draws the fate of a message of c on l. It returns the latency of the
+// message, and an error if it does not arrive. Caller must hold the lock.
+func (s *Sim) send(c *call, l link) (time.Duration, error) {
+	conf, ok := s.links[l]
+	if !ok {
+		conf = s.defaultLink
+	}
+	latency := time.Duration(0)
+	if conf.Latency != nil {
+		latency = conf.Latency(c.rand)
+	}
+	if conf.Loss > 0 && c.rand.Float64() < conf.Loss {
+		return latency, fmt.Errorf("%w: from %v to %v", ErrLost, l.from, l.to)
+	}
+	for _, p := range s.partitions {
+		if p.separates(l, s.now) {
+			return latency, fmt.Errorf("%w: between %v and %v", ErrPartitioned, l.from, l.to)
+		}
+	}
+	return latency, nil
+}
+
+// deliver sends a request from the node at from to the node at to, and returns
+// the response.
+func (s *Sim) deliver(ctx context.Context, from, to iface.Address, path string, data []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	if n, ok := s.nodes[from]; ok && !n.up {
+		s.lock.Unlock()
+		return nil, fmt.Errorf("%w: %v crashed", ErrUnreachable, from)
+	}
+	if n, ok := s.nodes[to]; !ok || !n.up {
+		s.lock.Unlock()
+		return nil, fmt.Errorf("%w: %v", ErrUnreachable, to)
+	}
+	c := s.newCall(ctx, link{from, to}, path, data)
+	out, err := s.send(c, c.link)
+	s.schedule(out, arrivalEvent, c.key, func() { s.arrive(c, err) })
+	if deadline, ok := ctx.Deadline(); ok {
+		s.schedule(deadline.Sub(simEpoch)-s.now, deadlineEvent, c.key, func() {
+			s.finish(c, nil, context.DeadlineExceeded)
+		})
+	}
+	s.pending++
+	s.lock.Unlock()
+
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			s.lock.Lock()
+			s.finish(c, nil, ctx.Err())
+			s.lock.Unlock()
+		}
+		// A deadline is also an event of the request, which ends it in the
+		// same order on every run.
+		<-c.done
+	}
+
+	s.lock.Lock()
+	s.pending--
+	s.lock.Unlock()
+	return c.resp, c.err
+}
+
+// arrive hands c to its recipient once it reached it, or fails it with err.
+// Caller must hold the lock.
+func (s *Sim) arrive(c *call, err error) {
+	select {
+	case <-c.done:
+		// The request timed out or was cancelled on the way.
+		return
+	default:
+	}
+	n, ok := s.nodes[c.to]
+	if err == nil && (!ok || !n.up) {
+		err = fmt.Errorf("%w: %v", ErrUnreachable, c.to)
+	}
+	if err != nil {
+		s.finish(c, nil, err)
+		return
+	}
+	s.record(c, "arrived")
+	d := n.dht
+	go func() {
+		resp := d.Respond(iface.WithRemoteAddr(c.ctx, c.from), c.path, c.data)
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		back, err := s.send(c, link{c.to, c.from})
+		s.schedule(back, responseEvent, c.key, func() { s.finish(c, resp, err) })
+	}()
+}
+
+// simNet is the network of a Sim as seen by the node at addr.
+type simNet struct {
+	sim  *Sim
+	addr iface.Address
+}
+
+var _ iface.Net = &simNet{}
+
+func (n *simNet) Get(ctx context.Context, addr iface.Address, path string) ([]byte, error) {
+	return n.sim.deliver(ctx, n.addr, addr, path, nil)
+}
+
+func (n *simNet) Put(ctx context.Context, addr iface.Address, path string, data []byte) error {
+	_, err := n.sim.deliver(ctx, n.addr, addr, path, data)
+	return err
+}
+
+func (n *simNet) Post(ctx context.Context, addr iface.Address, path string, data []byte) ([]byte, error) {
+	return n.sim.deliver(ctx, n.addr, addr, path, data)
+}
+
+// Listen blocks till shutdown, like TestNet.Listen.
+func (n *simNet) Listen(_ iface.Address, _ func(context.Context, string, []byte) []byte, shutdown chan bool) error {
+	<-shutdown
+	return nil
+}
@@ -0,0 +1,179 @@
+package testnet
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sakshamsharma/sarga/common/dht"
+	"github.com/sakshamsharma/sarga/common/iface"
+)
+
+var (
+	a = iface.Address{IP: "a", Port: 1}
+	b = iface.Address{IP: "b", Port: 1}
+)
+
+// newPair returns a Sim of two nodes, a and b.
+func newPair(seed int64) *Sim {
+	s := NewSim(seed)
+	s.Add(a, &dht.FakeDHT{})
+	s.Add(b, &dht.FakeDHT{})
+	return s
+}
+
+// outcomes sends n requests from a to b, each with a deadline of timeout, and
+// returns the outcome of each as a letter.
+func outcomes(s *Sim, n int, timeout time.Duration) string {
+	ret := ""
+	for i := 0; i < n; i++ {
+		ctx, cancel := iface.WithTimeout(context.Background(), s.Clock(), timeout)
+		_, err := s.Net(a).Post(ctx, b, "ping", nil)
+		cancel()
+		switch {
+		case err == nil:
+			ret += "."
+		case errors.Is(err, ErrLost):
+			ret += "l"
+		case errors.Is(err, context.DeadlineExceeded):
+			ret += "t"
+		default:
+			ret += "?"
+		}
+	}
+	return ret
+}
+
+func TestSimReproducible(t *testing.T) {
+	link := Link{Latency: Uniform(0, 100*time.Millisecond), Loss: 0.2}
+	runs := []string{}
+	for _, seed := range []int64{1, 1, 2} {
+		s := newPair(seed)
+		s.SetDefaultLink(link)
+		runs = append(runs, outcomes(s, 100, 120*time.Millisecond))
+	}
+
+	if runs[0] != runs[1] {
+		t.Fatalf("expected runs with the same seed to fail the same way, got %q and %q", runs[0], runs[1])
+	}
+	if runs[0] == runs[2] {
+		t.Fatalf("expected runs with different seeds to fail differently, got %q twice", runs[0])
+	}
+	for _, c := range ".lt" {
+		found := false
+		for _, o := range runs[0] {
+			found = found || o == c
+		}
+		if !found {
+			t.Fatalf("expected outcome %q in %q", c, runs[0])
+		}
+	}
+}
+
+// slowDHT is a FakeDHT which takes real time to respond. It keeps busy rather
+// than sleeping, since the Sim takes sleeping goroutines for blocked.
+type slowDHT struct {
+	dht.FakeDHT
+	delay time.Duration
+}
+
+func (d *slowDHT) Respond(ctx context.Context, path string, data []byte) []byte {
+	for start := time.Now(); time.Since(start) < d.delay; {
+	}
+	return d.FakeDHT.Respond(ctx, path, data)
+}
+
+func TestSimVirtualDeadline(t *testing.T) {
+	s := NewSim(1)
+	s.Add(a, &dht.FakeDHT{})
+	s.Add(b, &slowDHT{delay: 100 * time.Millisecond})
+	s.SetDefaultLink(Link{Latency: Constant(40 * time.Millisecond)})
+
+	// The real time b takes to respond does not count against the deadline,
+	// only the virtual round trip does.
+	ctx, cancel := iface.WithTimeout(context.Background(), s.Clock(), 150*time.Millisecond)
+	defer cancel()
+	if _, err := s.Net(a).Post(ctx, b, "ping", nil); err != nil {
+		t.Fatalf("expected a round trip within the deadline to succeed, got: %v", err)
+	}
+	ctx, cancel = iface.WithTimeout(context.Background(), s.Clock(), 60*time.Millisecond)
+	defer cancel()
+	if _, err := s.Net(a).Post(ctx, b, "ping", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a round trip past the deadline to time out, got: %v", err)
+	}
+}
+
+func TestSimClock(t *testing.T) {
+	s := newPair(1)
+	clock := s.Clock()
+	start := clock.Now()
+	fired := make(chan time.Duration, 2)
+	clock.AfterFunc(2*time.Minute, func() { fired <- clock.Now().Sub(start) })
+	stop := clock.AfterFunc(time.Minute, func() { fired <- 0 })
+	if !stop() {
+		t.Fatalf("expected a pending timer to stop")
+	}
+
+	// Timers only fire as the clock is advanced, and are done by the time
+	// Advance returns.
+	s.Advance(time.Minute)
+	if len(fired) != 0 {
+		t.Fatalf("expected no timer to fire before it is due")
+	}
+	s.Advance(time.Minute)
+	if len(fired) != 1 {
+		t.Fatalf("expected the timer to fire once due, %d fired", len(fired))
+	}
+	if elapsed := <-fired; elapsed != 2*time.Minute {
+		t.Fatalf("expected the timer to fire after %v, got %v", 2*time.Minute, elapsed)
+	}
+}
+
+func TestSimFaults(t *testing.T) {
+	s := newPair(1)
+	ctx := context.Background()
+
+	// A slow link times out, without slowing the test down.
+	s.SetLink(a, b, Link{Latency: Constant(time.Hour)})
+	timeout, cancel := iface.WithTimeout(ctx, s.Clock(), time.Second)
+	defer cancel()
+	if _, err := s.Net(a).Post(timeout, b, "ping", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a request over a slow link to time out, got: %v", err)
+	}
+	if _, err := s.Net(a).Post(ctx, b, "ping", nil); err != nil {
+		t.Fatalf("expected a request without a deadline to succeed, got: %v", err)
+	}
+	s.SetLink(a, b, Link{})
+
+	// Partitions start and heal with the virtual clock.
+	s.Partition(time.Minute, time.Minute, a)
+	if _, err := s.Net(a).Post(ctx, b, "ping", nil); err != nil {
+		t.Fatalf("expected no partition before it starts, got: %v", err)
+	}
+	s.Advance(time.Minute)
+	if _, err := s.Net(b).Post(ctx, a, "ping", nil); !errors.Is(err, ErrPartitioned) {
+		t.Fatalf("expected a partition, got: %v", err)
+	}
+	s.Advance(time.Minute)
+	if _, err := s.Net(b).Post(ctx, a, "ping", nil); err != nil {
+		t.Fatalf("expected the partition to heal, got: %v", err)
+	}
+
+	// Crashed nodes can neither be reached nor send requests.
+	s.Crash(b)
+	if _, err := s.Net(a).Post(ctx, b, "ping", nil); !errors.Is(err, ErrUnreachable) {
+		t.Fatalf("expected a crashed node to be unreachable, got: %v", err)
+	}
+	if _, err := s.Net(b).Post(ctx, a, "ping", nil); !errors.Is(err, ErrUnreachable) {
+		t.Fatalf("expected a crashed node to not send requests, got: %v", err)
+	}
+	s.Restart(b, &dht.FakeDHT{})
+	if _, err := s.Net(a).Post(ctx, b, "ping", nil); err != nil {
+		t.Fatalf("expected a restarted node to be reachable, got: %v", err)
+	}
+
+	if _, err := s.Net(a).Post(ctx, iface.Address{IP: "c"}, "ping", nil); !errors.Is(err, ErrUnreachable) {
+		t.Fatalf("expected an unknown address to be unreachable, got: %v", err)
+	}
+}